@@ -1,14 +1,20 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
 	"net/http/pprof"
+	"net/mail"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cbroglie/mustache"
@@ -22,7 +28,8 @@ import (
 var ErrorNotFound error = errors.New("Not Found")
 
 var (
-	TemplateIndexOf string
+	TemplateIndexOf   string
+	TemplateHistoryOf string
 
 	repoPath string
 	repo     *git.Repository
@@ -30,26 +37,40 @@ var (
 
 func init() {
 	TemplateIndexOf = string(data.MustAsset("indexOf.mustache"))
+	TemplateHistoryOf = string(data.MustAsset("historyOf.mustache"))
 }
 
 var debug bool
 
+// OpenRepo opens the repository the API works on. Run calls it, so it is only
+// needed for using the API without the server.
+func OpenRepo(path string) error {
+	var err error
+	repoPath = path
+	repo, err = git.OpenRepository(path)
+	return err
+}
+
 func Run(address, repoPath string, doDebug bool) error {
 	debug = doDebug
-	var err error
-	repo, err = git.OpenRepository(repoPath)
-	if err != nil {
+	if err := OpenRepo(repoPath); err != nil {
 		return err
 	}
 	log.Printf("repo:%+v\n", repo)
+	startMirrors()
+	go watchRefs()
 
 	router := httprouter.New()
 
 	router.GET("/*path", Index)
+	router.HEAD("/*path", Index)
 	router.PUT("/*path", putFileHandler)
+	router.DELETE("/*path", deleteFileHandler)
+	router.Handle("MOVE", "/*path", moveFileHandler)
+	router.POST("/*path", postHandler)
 
 	fmt.Println("Listening on", address)
-	return http.ListenAndServe(address, router)
+	return http.ListenAndServe(address, Authenticate(withSpecial(special, router)))
 }
 
 func Index(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
@@ -70,17 +91,47 @@ func Index(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	if jsonInfo {
 		ctx.path = strings.TrimSuffix(ctx.path, ".json")
 	}
+	ctx.urlPath = ctx.path
 
-	ctx.rootCommit, err = GetRootCommit()
+	ctx.rootCommit, err = GetBranchCommit(requestBranch(r))
 	Check(err, "getting commit", 0)
 	defer ctx.rootCommit.Free()
-	rootTreeO, err := ctx.rootCommit.Peel(git.ObjectTree)
-	Check(err, "getting tree", 0)
-	ctx.rootTree, err = rootTreeO.AsTree()
+	ctx.rootTree, err = GetCommitTree(ctx.rootCommit)
 	Check(err, "getting tree", 0)
 	defer ctx.rootTree.Free()
 
+	if historyOf, rev, rest, ok := splitHistoryPath(ctx.path); ok {
+		if rev == "" {
+			serveHistory(ctx, r, historyOf, jsonInfo)
+			return
+		}
+
+		// serve contents as they were at that commit
+		ctx.rootCommit, err = LookupRevision(rev)
+		if err == ErrorNotFound || isNotFound(err) {
+			http.NotFound(w, r)
+			return
+		}
+		Check(err, "resolving revision", http.StatusBadRequest)
+		defer ctx.rootCommit.Free()
+		ctx.rootTree, err = GetCommitTree(ctx.rootCommit)
+		Check(err, "getting tree", 0)
+		defer ctx.rootTree.Free()
+		ctx.path = strings.TrimSuffix(historyOf, "/") + rest
+		if ctx.path == "" {
+			ctx.path = "/"
+		}
+	}
+
 	entry, err := GetRepoPath(ctx.rootTree, ctx.path)
+	if isNotFound(err) && strings.HasSuffix(ctx.path, diffSuffix) {
+		serveDiff(ctx, r, strings.TrimSuffix(ctx.path, diffSuffix), jsonInfo)
+		return
+	}
+	if isNotFound(err) && jsonInfo && strings.HasSuffix(ctx.path, blameSuffix) {
+		serveBlame(ctx, r, strings.TrimSuffix(ctx.path, blameSuffix))
+		return
+	}
 	if err != nil && err.(*git.GitError).Code == git.ErrNotFound {
 		http.NotFound(w, r)
 		return
@@ -89,8 +140,17 @@ func Index(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 
 	switch entry.Type() {
 	case git.ObjectTree:
-		if !strings.HasSuffix(ctx.path, "/") {
-			http.Redirect(w, r, ctx.path+"/", http.StatusMovedPermanently)
+		if !strings.HasSuffix(ctx.urlPath, "/") {
+			http.Redirect(w, r, ctx.urlPath+"/", http.StatusMovedPermanently)
+			return
+		}
+
+		// listings include the history, which changes with HEAD
+		tag := etag(entry.Id().String(), ctx.rootCommit.Id().String())
+		if jsonInfo {
+			tag = etag(entry.Id().String(), ctx.rootCommit.Id().String(), "json")
+		}
+		if checkNotModified(w, r, tag) {
 			return
 		}
 
@@ -99,17 +159,24 @@ func Index(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		files := ListDirCurrent(tree)
 
 		if jsonInfo {
-			renderTreeJson(ctx, entry, files)
+			renderTreeJson(ctx, r, entry, files)
 		} else {
 			renderDirListing(ctx, files)
 		}
 	case git.ObjectBlob:
 		if jsonInfo {
-			renderJsonInfo(ctx, entry)
+			if checkNotModified(w, r, etag(entry.Id().String(),
+				ctx.rootCommit.Id().String(), "json")) {
+				return
+			}
+			renderJsonInfo(ctx, r, entry)
 		} else {
+			if checkNotModified(w, r, etag(entry.Id().String())) {
+				return
+			}
 			blob, err := entry.AsBlob()
 			Check(err, "getting blob", 0)
-			w.Write(blob.Contents())
+			serveBlob(ctx, r, blob)
 		}
 	default:
 		http.Error(w, "Unknown entry: "+entry.Type().String(),
@@ -117,6 +184,34 @@ func Index(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	}
 }
 
+// contentTypes overrides the types known to the mime package.
+var contentTypes = map[string]string{
+	".md":       "text/markdown; charset=utf-8",
+	".markdown": "text/markdown; charset=utf-8",
+}
+
+// contentType determines the type of a file from its extension, and falls
+// back to sniffing its content.
+func contentType(name string, content []byte) string {
+	ext := strings.ToLower(path.Ext(name))
+	if t, ok := contentTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return http.DetectContentType(content)
+}
+
+// serveBlob sends the contents of a file. Range requests are supported, so
+// that downloads of large attachments can be resumed.
+func serveBlob(ctx *RequestContext, r *http.Request, blob *git.Blob) {
+	content := blob.Contents()
+	ctx.w.Header().Set("Content-Type", contentType(ctx.path, content))
+	ctx.w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(ctx.w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
 func renderDirListing(ctx *RequestContext, files []GitEntry) {
 	// Add top-level link, but only for the dir listing.
 	if ctx.path != "/" {
@@ -128,9 +223,10 @@ func renderDirListing(ctx *RequestContext, files []GitEntry) {
 	ctx.w.Write([]byte(html))
 }
 
-func renderTreeJson(ctx *RequestContext, object *git.Object, files []GitEntry) {
-	commitInfos, err := getCommitInfos(ctx.rootCommit, object, ctx.path)
-	Check(err, "getting history", http.StatusInternalServerError)
+func renderTreeJson(ctx *RequestContext, r *http.Request, object *git.Object, files []GitEntry) {
+	after, limit := requestHistoryPage(r)
+	commitInfos, err := getCommitInfoPage(ctx.rootCommit, object, ctx.path, after, limit)
+	Check(err, "getting history", historyErrorCode(err))
 	info := TreeInfo{
 		FileInfo: FileInfo{
 			ID:   (*Oid)(object.Id()),
@@ -142,91 +238,176 @@ func renderTreeJson(ctx *RequestContext, object *git.Object, files []GitEntry) {
 	ctx.w.Write(b)
 }
 
-func renderJsonInfo(ctx *RequestContext, object *git.Object) {
-	commitInfos, err := getCommitInfos(ctx.rootCommit, object, ctx.path)
-	Check(err, "getting history", http.StatusInternalServerError)
+func renderJsonInfo(ctx *RequestContext, r *http.Request, object *git.Object) {
+	after, limit := requestHistoryPage(r)
+	commitInfos, err := getCommitInfoPage(ctx.rootCommit, object, ctx.path, after, limit)
+	Check(err, "getting history", historyErrorCode(err))
 	info := FileInfo{
 		ID:   (*Oid)(object.Id()),
 		Path: ctx.path, History: commitInfos}
+	addLinks(ctx, &info)
 
 	b, err := json.MarshalIndent(&info, "", "  ")
 	Check(err, "rendering JSON", http.StatusInternalServerError)
 	ctx.w.Write(b)
 }
 
+// getCommitInfos returns the history of path, newest first: parentCommit, and
+// for each older version of path the newest commit which still had it.
+// Renames of files are followed.
 func getCommitInfos(parentCommit *git.Commit, object *git.Object, path string) ([]CommitInfo, error) {
-	// get commit info
-	walk, err := repo.Walk()
+	return getCommitInfoPage(parentCommit, object, path, nil, 0)
+}
+
+// getCommitInfoPage returns up to limit entries of the history of path, all
+// if limit is 0. If after is given, the entries following its entry are
+// returned. Older versions are found with the change index, so that only the
+// commits in the history are read.
+func getCommitInfoPage(parentCommit *git.Commit, object *git.Object, path string,
+	after *git.Oid, limit int) ([]CommitInfo, error) {
+	changeIdx.Lock()
+	defer changeIdx.Unlock()
+	node, err := changeIdx.index(parentCommit.Id())
 	if err != nil {
 		return nil, err
 	}
-	defer walk.Free()
-	if err = walk.Push(parentCommit.Id()); err != nil {
-		return nil, err
-	}
-	walk.Sorting(git.SortTime | git.SortTopological)
-	walk.SimplifyFirstParent()
-	walk.Hide(object.Id())
-	walk.HideGlob("tags/*")
 
 	res := []CommitInfo{}
-	var currentCommitId git.Oid
-	var currentFileId *git.Oid
-	// walk backwards in history
-	for {
-		err = walk.Next(&currentCommitId)
-		if err != nil {
-			break
+	currentFileId := object.Id()
+	skipping := false
+	if after != nil {
+		afterNode := changeIdx.nodes[*after]
+		if afterNode == nil || node.ancestor(afterNode.depth) != afterNode {
+			return nil, errNotInHistory
 		}
-
-		// get path at at that commit
-		currentCommit, err := repo.LookupCommit(&currentCommitId)
+		afterCommit, err := repo.LookupCommit(after)
 		if err != nil {
 			return nil, err
 		}
-		currentTreeO, err := currentCommit.Peel(git.ObjectTree)
+		objectAtCommit, err := lookupAt(afterCommit, path)
+		afterCommit.Free()
 		if err != nil {
 			return nil, err
 		}
-		currentTree, err := currentTreeO.AsTree()
-		if err != nil {
-			return nil, err
+		if objectAtCommit != nil {
+			node, currentFileId = afterNode, objectAtCommit.Id()
+			objectAtCommit.Free()
+		} else {
+			// renamed since, so go through the newer entries
+			skipping = true
 		}
+	}
+	addEntry := func(commit *git.Commit) {
+		if skipping {
+			skipping = !commit.Id().Equal(after)
+			return
+		}
+		res = append(res, newCommitInfo(commit, currentFileId))
+	}
+	if after == nil || skipping {
+		addEntry(parentCommit)
+	}
 
-		objectAtCommit, err := GetRepoPath(currentTree, path)
-		if err != nil && err.(*git.GitError).Code == git.ErrNotFound {
-			// file appeared the commit before
+	// walk backwards in history, from change to change
+	for limit == 0 || len(res) < limit {
+		change := changeIdx.lastChange(node, strings.Trim(path, "/"), currentFileId)
+		if last := len(res) - 1; change != nil && last >= 0 &&
+			res[last].fileId.Equal(currentFileId) {
+			// older changes to the same version, like of the mode, win
+			res[last].changedBy = &change.id
+		}
+		if change == nil || change.parent == nil {
+			// file appeared with the first commit
 			break
 		}
+		// the newest commit with the previous version is the parent
+		commit, err := repo.LookupCommit(&change.parent.id)
+		if err != nil {
+			return nil, err
+		}
+		oldPath, fileId, err := versionBefore(commit, &change.id, path)
 		if err != nil {
+			commit.Free()
 			return nil, err
 		}
-		if objectAtCommit == nil {
+		if fileId == nil {
+			// file appeared with the change
+			commit.Free()
 			break
 		}
-		if currentFileId != nil && objectAtCommit.Id().Equal(currentFileId) {
-			// file did not change at that revision
+		node = change.parent
+		renamed := oldPath != path
+		path = oldPath
+		if fileId.Equal(currentFileId) && !renamed {
+			// only the mode changed
+			commit.Free()
 			continue
 		}
-		currentFileId = objectAtCommit.Id()
-		// if we arrive here, the file changed at this revision! mark it!
+		currentFileId = fileId
+		addEntry(commit)
+		commit.Free()
+	}
+	return res, nil
+}
 
-		commit, err := repo.LookupCommit(&currentCommitId)
-		if err != nil {
-			return nil, err
-		}
-		info := CommitInfo{
-			(*Oid)(commit.Id()),
-			commit.Author().When,
-			strings.TrimSpace(commit.Message()),
-			AuthorInfo{commit.Author().Name, commit.Author().Email},
+// versionBefore returns the path and version of a file at commit, the parent
+// of the change id, following the file if the change renamed it. The version
+// is nil if the file did not exist at commit.
+func versionBefore(commit *git.Commit, id *git.Oid, path string) (string, *git.Oid, error) {
+	tree, err := GetCommitTree(commit)
+	if err != nil {
+		return "", nil, err
+	}
+	defer tree.Free()
+	if path == "/" || path == "" {
+		return path, tree.Id(), nil
+	}
+
+	entry, err := tree.EntryByPath(path[1:])
+	if isNotFound(err) {
+		oldPath, err := findRenameBy(id, tree, path)
+		if err != nil || oldPath == "" {
+			return "", nil, err
 		}
-		res = append(res, info)
+		path = oldPath
+		entry, err = tree.EntryByPath(path[1:])
 	}
-	if err != nil && err.(*git.GitError).Code != git.ErrIterOver {
-		return nil, err
+	if isNotFound(err) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return path, entry.Id, nil
+}
+
+// findRenameBy returns the path a file had in older if the commit id renamed
+// it to path.
+func findRenameBy(id *git.Oid, older *git.Tree, path string) (string, error) {
+	commit, err := repo.LookupCommit(id)
+	if err != nil {
+		return "", err
+	}
+	defer commit.Free()
+	newer, err := GetCommitTree(commit)
+	if err != nil {
+		return "", err
+	}
+	defer newer.Free()
+	return findRename(older, newer, path)
+}
+
+// newCommitInfo describes commit in a history, in which path had the version
+// fileId.
+func newCommitInfo(commit *git.Commit, fileId *git.Oid) CommitInfo {
+	author := commit.Author()
+	return CommitInfo{
+		ID:        (*Oid)(commit.Id()),
+		Date:      author.When,
+		CommitMsg: strings.TrimSpace(commit.Message()),
+		Author:    AuthorInfo{author.Name, author.Email},
+		fileId:    fileId,
 	}
-	return res, nil
 }
 
 // checkPath checks that a path makes sense.
@@ -244,6 +425,18 @@ func checkPath(path string) (string, error) {
 	return path, nil
 }
 
+// postHandler dispatches POST requests by their query parameters.
+func postHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	switch {
+	case r.URL.Query().Get("move") != "":
+		moveFileHandler(w, r, p)
+	case strings.HasSuffix(p.ByName("path"), revertSuffix):
+		revertFileHandler(w, r, p)
+	default:
+		http.Error(w, "Unknown POST request.", http.StatusBadRequest)
+	}
+}
+
 func putFileHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
 	var err error
@@ -252,110 +445,430 @@ func putFileHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params)
 	path, err = checkPath(path)
 	Check(err, "in supplied path", http.StatusBadRequest)
 
-	lastId := r.Header.Get("Wiki-Last-Id")
-	commitMsg := r.Header.Get("Wiki-Commit-Msg")
+	lastId, conditional := requestLastId(r)
+	merge, _ := strconv.ParseBool(r.Header.Get("Wiki-Merge"))
+	meta := requestCommitMeta(r)
 
-	err, code := PutFile(path, lastId, commitMsg, r.Body)
+	err, code := PutFile(path, lastId, merge, meta, r.Body)
+	if conflict, ok := err.(*MergeConflict); ok {
+		renderConflict(w, conflict)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), code)
+		writeResult(w, err, code, conditional)
 	}
 }
 
-func PutFile(path, lastId, commitMsg string, body io.Reader) (error, int) {
-	if strings.HasSuffix(path, ".json") {
-		return errors.New("Files cannot end in \".json\"."), http.StatusConflict
+// PutFile stores body at path, and commits it to HEAD.
+// If merge is set and lastId names an older version of the file, the changes
+// are merged into the current version. Conflicts are returned as
+// *MergeConflict.
+// The commit id is returned as error with status 200.
+func PutFile(path, lastId string, merge bool, meta CommitMeta, body io.Reader) (error, int) {
+	content, err := ioutil.ReadAll(body)
+	Check(err, "receiving request", 0)
+	blobId, err, code := createFileBlob(path, content)
+	if err != nil {
+		return err, code
+	}
+	if merge {
+		if err, code := checkMergeBase(path, lastId, meta.Branch); err != nil {
+			return err, code
+		}
+	} else {
+		content = nil
 	}
 
-	var headCommits []*git.Commit
-	var oldRootTree *git.Tree
-	if head, err := repo.Head(); err == nil {
-		headCommitObject, err := head.Peel(git.ObjectCommit)
-		Check(err, "getting HEAD", 0)
-		headCommit, err := headCommitObject.AsCommit()
-		Check(err, "getting HEAD", 0)
-		headCommits = append(headCommits, headCommit)
-
-		oldRootTree, err = GetTreeFromRef(head)
-		Check(err, "getting HEAD tree", 0)
-		defer oldRootTree.Free()
+	return changeHead(meta, putChange(path, lastId, blobId, git.FilemodeBlob, content))
+}
 
-		oldEntry, err := GetRepoPath(oldRootTree, path)
-		if err != nil && err.(*git.GitError).Code == git.ErrNotFound {
-			oldEntry = nil
-		} else if err != nil {
-			return errors.New("Could not get path: " + err.Error()), 0
+// createFileBlob checks that content may be stored at path, and writes it to
+// the repository.
+func createFileBlob(path string, content []byte) (*git.Oid, error, int) {
+	if err, code := checkWritePath(path); err != nil {
+		return nil, err, code
+	}
+	if path == AuthFile {
+		if err := validateAuthFile(content); err != nil {
+			return nil, errors.New("Invalid auth file: " + err.Error()), http.StatusConflict
 		}
+	}
+	blobId, err := repo.CreateBlobFromBuffer(content)
+	if err != nil {
+		return nil, errors.Wrap(err, "writing request blob"), 0
+	}
+	return blobId, nil, http.StatusOK
+}
 
-		if oldEntry != nil {
-			switch oldEntry.Type() {
-			case git.ObjectTree:
-				return errors.New("Specified path exists and is a directory."),
-					http.StatusConflict
+// putChange stores the blob blobId at path, with mode. If ours holds the
+// content of the blob and lastId names an older version of the file, the
+// changes are merged.
+func putChange(path, lastId string, blobId *git.Oid, mode git.Filemode, ours []byte) indexChange {
+	merge := ours != nil
+	return func(oldRootTree *git.Tree, index *git.Index) (error, int) {
+		newId := blobId
+		if oldRootTree == nil {
+			if lastId != "" && lastId != "null" {
+				return lastIdError("lastId specified but no commit exists."),
+					http.StatusGone
+			}
+		} else {
+			oldEntry, err := lookupOld(oldRootTree, path)
+			if err != nil {
+				return errors.New("Could not get path: " + err.Error()), 0
+			}
 
-			case git.ObjectBlob:
-				switch lastId {
-				case "":
-					// no checks to perform
-				case "null":
-					return errors.New("lastId was null but specified path exists."),
+			if oldEntry != nil {
+				switch oldEntry.Type() {
+				case git.ObjectTree:
+					return errors.New("Specified path exists and is a directory."),
 						http.StatusConflict
-				default:
-					if lastId != oldEntry.Id().String() {
-						return errors.New("lastId did not match existing entry."),
-							http.StatusConflict
+
+				case git.ObjectBlob:
+					err, code := checkLastId(oldEntry.Id(), lastId)
+					if err != nil && merge && lastId != "null" && lastId != "*" {
+						newId, err, code = mergeBlob(path, lastId, oldEntry, ours)
+					}
+					if err != nil {
+						return err, code
 					}
+				default:
+					return errors.New("Unknown old entry: " + oldEntry.Type().String()), 0
+				}
+			} else {
+				if lastId != "" && lastId != "null" {
+					return lastIdError("lastId specified but specified path does not exist."),
+						http.StatusGone
 				}
-			default:
-				return errors.New("Unknown old entry: " + oldEntry.Type().String()), 0
-			}
-		} else {
-			if lastId != "" && lastId != "null" {
-				return errors.New("lastId specified but specified path does not exist."),
-					http.StatusGone
 			}
 		}
-	} else {
-		if lastId != "" && lastId != "null" {
-			return errors.New("lastId specified but no commit exists."),
-				http.StatusGone
+		// all checks okay, add and commit!
+
+		entry := git.IndexEntry{
+			Mode: mode,
+			Id:   newId,
+			Path: path[1:], // without / at the beginning
 		}
+		return index.Add(&entry), 0
 	}
-	// all checks okay, add, lock, and commit!
+}
 
-	//TODO lock
+func deleteFileHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+	var err error
 
-	content, err := ioutil.ReadAll(body)
-	Check(err, "receiving request", 0)
-	blobId, err := repo.CreateBlobFromBuffer(content)
-	Check(err, "writing request blob", 0)
-	content = nil
+	path := p.ByName("path")
+	path, err = checkPath(path)
+	Check(err, "in supplied path", http.StatusBadRequest)
+
+	lastId, conditional := requestLastId(r)
+	meta := requestCommitMeta(r)
+
+	err, code := DeleteFile(path, lastId, meta)
+	if err != nil {
+		writeResult(w, err, code, conditional)
+	}
+}
+
+// DeleteFile removes a file or a whole directory from HEAD and commits the
+// result. Like PutFile, the commit id is returned as error with status 200.
+func DeleteFile(path, lastId string, meta CommitMeta) (error, int) {
+	return changeHead(meta, deleteChange(path, lastId))
+}
+
+// deleteChange removes the file or directory at path.
+func deleteChange(path, lastId string) indexChange {
+	return func(oldRootTree *git.Tree, index *git.Index) (error, int) {
+		if path == "/" {
+			return errors.New("Cannot delete the root directory."), http.StatusConflict
+		}
+		if oldRootTree == nil {
+			return errors.New("No commit exists."), http.StatusNotFound
+		}
+		oldEntry, err := lookupOld(oldRootTree, path)
+		if err != nil {
+			return errors.New("Could not get path: " + err.Error()), 0
+		}
+		if oldEntry == nil {
+			return errors.New("Specified path does not exist."), http.StatusNotFound
+		}
+		if err, code := checkLastId(oldEntry.Id(), lastId); err != nil {
+			return err, code
+		}
+
+		switch oldEntry.Type() {
+		case git.ObjectTree:
+			return removeDirFromIndex(index, path), 0
+		case git.ObjectBlob:
+			return index.RemoveByPath(path[1:]), 0
+		default:
+			return errors.New("Unknown old entry: " + oldEntry.Type().String()), 0
+		}
+	}
+}
+
+// indexChange applies a change to an index holding oldRootTree, which is nil
+// if nothing was committed yet.
+type indexChange func(oldRootTree *git.Tree, index *git.Index) (error, int)
+
+// writeLock serializes all commits made through the API.
+var writeLock sync.Mutex
+
+// maxCommitTries limits how often a change is applied again when HEAD was
+// moved by somebody else while committing.
+const maxCommitTries = 3
+
+// changeHead applies a change to an index holding the tree of HEAD, and
+// commits the result on top of HEAD. oldRootTree is nil if nothing was
+// committed yet. If change returns an error, nothing is committed.
+// If meta.Branch is set, that branch is used instead of HEAD.
+//
+// Commits are serialized, and HEAD is only moved if it still points to the
+// commit the change was based on. Otherwise, the change is applied again on the
+// new HEAD, and rejected with 409 Conflict after maxCommitTries.
+// Like PutFile, the commit id is returned as error with status 200.
+func changeHead(meta CommitMeta, change indexChange) (error, int) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	for try := 1; ; try++ {
+		commitId, err, code := tryChangeHead(meta, change)
+		if err == errHeadMoved && try < maxCommitTries {
+			log.Println("HEAD moved while committing, retrying")
+			continue
+		}
+		if err == errHeadMoved {
+			return errors.New("HEAD was modified concurrently, please retry."),
+				http.StatusConflict
+		}
+		if err != nil {
+			return err, code
+		}
+		runCommitHooks(meta.Branch, commitId)
+		return errors.New(commitId.String()), http.StatusOK
+	}
+}
+
+func tryChangeHead(meta CommitMeta, change indexChange) (*git.Oid, error, int) {
+	headCommits, oldRootTree, err := readBranch(meta.Branch)
+	if err == errNoBranch {
+		return nil, err, http.StatusNotFound
+	}
+	Check(err, "getting HEAD", 0)
+	defer freeCommits(headCommits)
+	if oldRootTree != nil {
+		defer oldRootTree.Free()
+	}
 
 	index, err := git.NewIndex()
 	Check(err, "creating index", 0)
+	defer index.Free()
 	if oldRootTree != nil {
 		Check(index.ReadTree(oldRootTree), "Adding old files to index", 0)
 	}
 
-	entry := git.IndexEntry{
-		Mode: git.FilemodeBlob,
-		Size: uint32(len(content)),
-		Id:   blobId,
-		Path: path[1:], // without / at the beginning
+	if err, code := change(oldRootTree, index); err != nil {
+		return nil, err, code
 	}
-	Check(index.Add(&entry), "adding file to index", 0)
+
+	commitId, err := commitIndex(index, meta, headCommits)
+	if err == errHeadMoved {
+		return nil, err, 0
+	}
+	Check(err, "creating commit", 0)
+	return commitId, nil, http.StatusOK
+}
+
+// checkWritePath checks that a file can be created at path without clashing
+// with the special URLs.
+func checkWritePath(path string) (error, int) {
+	if strings.HasSuffix(path, ".json") {
+		return errors.New("Files cannot end in \".json\"."), http.StatusConflict
+	}
+	if isReserved(path) {
+		return errors.New("\"/" + topLevelName(path) + "\" is reserved."),
+			http.StatusConflict
+	}
+	for _, el := range strings.Split(path[1:], "/") {
+		if strings.HasSuffix(el, historySuffix) {
+			return errors.New("Path elements cannot end in \"" + historySuffix + "\"."),
+				http.StatusConflict
+		}
+	}
+	return nil, http.StatusOK
+}
+
+func moveFileHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+	var err error
+
+	path := p.ByName("path")
+	path, err = checkPath(path)
+	Check(err, "in supplied path", http.StatusBadRequest)
+
+	destination := r.Header.Get("Wiki-Destination")
+	if destination == "" {
+		destination = r.URL.Query().Get("move")
+	}
+	destination, err = checkPath(destination)
+	Check(err, "in destination", http.StatusBadRequest)
+	checkProtectedWrite(r, destination)
+
+	lastId, conditional := requestLastId(r)
+	meta := requestCommitMeta(r)
+
+	err, code := MoveFile(path, destination, lastId, meta)
+	if err != nil {
+		writeResult(w, err, code, conditional)
+	}
+}
+
+// MoveFile moves a file or a whole directory to destination in one commit.
+// Like PutFile, the commit id is returned as error with status 200.
+func MoveFile(path, destination, lastId string, meta CommitMeta) (error, int) {
+	return changeHead(meta, moveChange(path, destination, lastId))
+}
+
+// moveChange moves the file or directory at path to destination.
+func moveChange(path, destination, lastId string) indexChange {
+	path = strings.TrimSuffix(path, "/")
+	destination = strings.TrimSuffix(destination, "/")
+	return func(oldRootTree *git.Tree, index *git.Index) (error, int) {
+		if path == "" || destination == "" {
+			return errors.New("Cannot move the root directory."), http.StatusConflict
+		}
+		if strings.HasPrefix(destination+"/", path+"/") {
+			return errors.New("Cannot move a path into itself."), http.StatusConflict
+		}
+		if err, code := checkWritePath(destination); err != nil {
+			return err, code
+		}
+		if oldRootTree == nil {
+			return errors.New("No commit exists."), http.StatusNotFound
+		}
+		oldEntry, err := lookupOld(oldRootTree, path)
+		if err != nil {
+			return errors.New("Could not get path: " + err.Error()), 0
+		}
+		if oldEntry == nil {
+			return errors.New("Specified path does not exist."), http.StatusNotFound
+		}
+		if err, code := checkLastId(oldEntry.Id(), lastId); err != nil {
+			return err, code
+		}
+		destEntry, err := lookupOld(oldRootTree, destination)
+		if err != nil {
+			return errors.New("Could not get destination: " + err.Error()), 0
+		}
+		if destEntry != nil {
+			return errors.New("Destination exists."), http.StatusConflict
+		}
+
+		return moveInIndex(index, path, destination), 0
+	}
+}
+
+// checkLastId verifies the Wiki-Last-Id supplied by a client against the id
+// of the entry currently stored at that path.
+func checkLastId(oldId *git.Oid, lastId string) (error, int) {
+	switch lastId {
+	case "", "*":
+		// no checks to perform, or only that the entry exists
+	case "null":
+		return lastIdError("lastId was null but specified path exists."),
+			http.StatusConflict
+	default:
+		if lastId != oldId.String() {
+			return lastIdError("lastId did not match existing entry."),
+				http.StatusConflict
+		}
+	}
+	return nil, http.StatusOK
+}
+
+// requestCommitMeta collects commit message, author and branch for a write
+// request.
+// The author is the authenticated user. Trusted users may instead specify
+// author and date with the Wiki-Author and Wiki-Date headers.
+func requestCommitMeta(r *http.Request) CommitMeta {
+	meta := CommitMeta{
+		Message: r.Header.Get("Wiki-Commit-Msg"),
+		Branch:  requestBranch(r)}
+	user := RequestUser(r)
+	if user != nil {
+		meta.Author = AuthorInfo{user.Name, user.Email}
+		meta.Committer = meta.Author
+	}
+
+	authorHeader := r.Header.Get("Wiki-Author")
+	dateHeader := r.Header.Get("Wiki-Date")
+	if authorHeader == "" && dateHeader == "" {
+		return meta
+	}
+	if user != nil && !user.Trusted {
+		panic(HttpError{"Only trusted users may set Wiki-Author or Wiki-Date.",
+			http.StatusForbidden})
+	}
+	if authorHeader != "" {
+		address, err := mail.ParseAddress(authorHeader)
+		Check(err, "parsing Wiki-Author", http.StatusBadRequest)
+		meta.Author = AuthorInfo{address.Name, address.Address}
+	}
+	if dateHeader != "" {
+		date, err := time.Parse(time.RFC3339, dateHeader)
+		Check(err, "parsing Wiki-Date", http.StatusBadRequest)
+		meta.Date = date
+	}
+	return meta
+}
+
+// signature converts an AuthorInfo to a git signature, filling in defaults
+// for missing fields.
+func signature(info AuthorInfo, when time.Time) *git.Signature {
+	sig := &git.Signature{
+		Name:  info.Name,
+		Email: info.Email,
+		When:  when}
+	if sig.Name == "" {
+		sig.Name = "root"
+	}
+	if sig.Email == "" {
+		sig.Email = "root@localhost"
+	}
+	return sig
+}
+
+// commitIndex writes the index to a new tree and commits it to HEAD, or to
+// meta.Branch. If the branch does not point to the first of parents anymore,
+// errHeadMoved is returned.
+func commitIndex(index *git.Index, meta CommitMeta, parents []*git.Commit) (*git.Oid, error) {
 	treeId, err := index.WriteTreeTo(repo)
-	Check(err, "writing new tree", 0)
+	if err != nil {
+		return nil, err
+	}
 	tree, err := repo.LookupTree(treeId)
-	Check(err, "getting new tree", 0)
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
 
-	author := &git.Signature{ //TODO add user info
-		Email: "root@localhost",
-		Name:  "root",
-		When:  time.Now()}
-	committer := author
+	now := time.Now()
+	authorDate := meta.Date
+	if authorDate.IsZero() {
+		authorDate = now
+	}
+	committerInfo := meta.Committer
+	if committerInfo == (AuthorInfo{}) {
+		committerInfo = meta.Author
+	}
+	author := signature(meta.Author, authorDate)
+	committer := signature(committerInfo, now)
 
-	commitId, err := repo.CreateCommit("HEAD", author, committer, commitMsg, tree,
-		headCommits...)
-	Check(err, "creating commit", 0)
-	return errors.New(commitId.String()), http.StatusOK
+	commitId, err := repo.CreateCommit("", author, committer, meta.Message, tree,
+		parents...)
+	if err != nil {
+		return nil, err
+	}
+	return commitId, updateBranch(meta.Branch, commitId, parents,
+		"commit: "+strings.SplitN(meta.Message, "\n", 2)[0])
 }
@@ -2,15 +2,25 @@ package api_test
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -19,11 +29,24 @@ import (
 	"github.com/cfstras/wiki-api/data"
 
 	"github.com/cfstras/wiki-api/api"
+	git "github.com/libgit2/git2go"
 	"github.com/stretchr/testify/assert"
 )
 
 var port int
 
+// repoPath is the repository the server is running on, mirrorPath the
+// repository it is mirrored to.
+var repoPath, mirrorPath string
+
+type webhookRequest struct {
+	signature string
+	body      []byte
+}
+
+// webhookRequests receives the requests to the webhook configured in TestMain.
+var webhookRequests = make(chan webhookRequest, 1000)
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 	no := func(err error) {
@@ -66,8 +89,25 @@ func TestMain(m *testing.M) {
 		no(ioutil.WriteFile(to, content, 0644))
 	}
 
+	hookServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			no(err)
+			webhookRequests <- webhookRequest{r.Header.Get("X-Wiki-Signature"), body}
+		}))
+	defer hookServer.Close()
+	mirrorPath = tmp + "mirror.git"
+	mirror, err := git.InitRepository(mirrorPath, true)
+	no(err)
+	mirror.Free()
+	no(ioutil.WriteFile(tmp+"config.json", []byte(`{
+		"Webhooks": [{"URL": "`+hookServer.URL+`", "Secret": "hook-secret"}],
+		"Mirrors": [{"URL": "`+mirrorPath+`"}]}`), 0644))
+	no(api.LoadConfig(tmp + "config.json"))
+
+	repoPath = tmp + "wiki-test.git"
 	go func() {
-		err := api.Run(fmt.Sprintf(":%d", port), tmp+"wiki-test.git", false)
+		err := api.Run(fmt.Sprintf(":%d", port), repoPath, false)
 		no(err)
 	}()
 	// wait until ready
@@ -257,6 +297,170 @@ func TestGetListing(t *testing.T) {
 	}
 }
 
+// getJSON fetches a URL and decodes the JSON response into v.
+func getJSON(t *testing.T, url string, v interface{}) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", port, url))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if !assert.Equal(t, http.StatusOK, resp.StatusCode, url) {
+		t.FailNow()
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(v), url)
+}
+
+type historyEntry struct {
+	Name  string
+	IsDir bool
+}
+
+// TestHistory verifies the history listings of files and folders.
+func TestHistory(t *testing.T) {
+	var listing struct {
+		Path    string
+		Entries []historyEntry
+	}
+
+	getJSON(t, "/foo/foo.txt.history/.json", &listing)
+	assert.Equal(t, "/foo/foo.txt", listing.Path)
+	assert.Equal(t, []historyEntry{
+		{"3-663a51383fc6fc6052a2570b9aff4c90a035305c", false},
+		{"2-2c35554157d56445d70ce121e4764f864a4c92bb", false},
+		{"1-94b931b4ecb3f461304dbf7a751b0c12cffaa9bf", false},
+	}, listing.Entries)
+
+	getJSON(t, "/foo/bar/baz.history.json", &listing)
+	assert.Equal(t, "/foo/bar/baz/", listing.Path)
+	assert.Equal(t, []historyEntry{
+		{"1-663a51383fc6fc6052a2570b9aff4c90a035305c", true},
+	}, listing.Entries)
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/foo/foo.txt.history", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bodyB, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "/foo/foo.txt.history/", resp.Request.URL.Path)
+	assert.Contains(t, string(bodyB), "History of /foo/foo.txt")
+	assert.Contains(t, string(bodyB),
+		`href="1-94b931b4ecb3f461304dbf7a751b0c12cffaa9bf"`)
+
+	resp, err = http.Get(fmt.Sprintf("http://127.0.0.1:%d/nope.md.history/", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+// TestHistoryPaging verifies that histories can be fetched in pages, and that
+// the change index they are read from is saved.
+func TestHistoryPaging(t *testing.T) {
+	var info struct {
+		History []struct{ ID string }
+	}
+	ids := func() []string {
+		res := []string{}
+		for _, entry := range info.History {
+			res = append(res, entry.ID)
+		}
+		return res
+	}
+	getJSON(t, "/foo/foo.txt.json?limit=2", &info)
+	assert.Equal(t, []string{
+		"663a51383fc6fc6052a2570b9aff4c90a035305c",
+		"2c35554157d56445d70ce121e4764f864a4c92bb",
+	}, ids())
+	getJSON(t, "/foo/foo.txt.json?limit=2&after=2c35554157d56445d70ce121e4764f864a4c92bb", &info)
+	assert.Equal(t, []string{"94b931b4ecb3f461304dbf7a751b0c12cffaa9bf"}, ids())
+	getJSON(t, "/foo/bar/baz/.json?limit=1", &info)
+	assert.Equal(t, []string{"663a51383fc6fc6052a2570b9aff4c90a035305c"}, ids())
+
+	var listing struct {
+		Entries []historyEntry
+	}
+	getJSON(t, "/foo/foo.txt.history/.json?limit=1&after=663a5138", &listing)
+	assert.Equal(t, []historyEntry{
+		{"2-2c35554157d56445d70ce121e4764f864a4c92bb", false},
+	}, listing.Entries)
+
+	testRequest(t, testCase{url: "/foo/foo.txt.json?limit=0",
+		expected: "limit must be positive.\n"})
+	testRequest(t, testCase{url: "/foo/foo.txt.json?after=deadbeef",
+		expected: "Revision not found: deadbeef\n"})
+
+	b, err := ioutil.ReadFile(repoPath + "/wiki-changes")
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(b), `"ID":"663a51383fc6fc6052a2570b9aff4c90a035305c"`)
+		assert.Contains(t, string(b), `"foo/foo.txt":"7c6ded14ecffa0341f8dc68fb674d4ae26d34644"`)
+	}
+}
+
+// TestHistoricContent verifies that files and folders can be fetched as they
+// were at an older commit.
+func TestHistoricContent(t *testing.T) {
+	contains := func(t *testing.T, expected, actual string) {
+		assert.Contains(t, actual, expected)
+	}
+	cases := []testCase{
+		{url: "/foo/foo.txt.history/1-94b931b4", expected: "foo.txt\n"},
+		{url: "/foo/foo.txt.history/2c35554157d56445d70ce121e4764f864a4c92bb",
+			expected: "foo.txt\nyup\n"},
+		{url: "/foo.history/2c355541/main.md", expected: "rewrite\nmore stuff\n"},
+		{url: "/foo.history/2c355541", compareResponse: contains,
+			expected: `<a href="main.md">main.md</a>`},
+		{url: "/foo/foo.txt.history/deadbeef", expected: "404 page not found\n"},
+		{url: "/foo/foo.txt.history/not-a-commit", expected: "404 page not found\n"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.url, func(t *testing.T) {
+			testRequest(t, c)
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	contains := func(t *testing.T, expected, actual string) {
+		assert.Contains(t, actual, expected)
+	}
+	cases := []testCase{
+		{url: "/foo/foo.txt.diff?from=94b931b4&to=2c355541",
+			expected: "--- a/foo/foo.txt\n+++ b/foo/foo.txt\n" +
+				"@@ -1 +1,2 @@\n foo.txt\n+yup\n"},
+		{url: "/foo/foo.txt.diff", compareResponse: contains,
+			expected: " foo.txt\n-yup\n"},
+		{url: "/foo/foo.txt.diff?from=1cc1", compareResponse: contains,
+			expected: "--- /dev/null\n+++ b/foo/foo.txt\n"},
+		{url: "/foo/foo.txt.diff?from=deadbeef", expected: "404 page not found\n"},
+		{url: "/nothing.txt.diff", expected: "404 page not found\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.url, func(t *testing.T) {
+			testRequest(t, c)
+		})
+	}
+
+	var diff struct {
+		Path  string
+		Hunks []api.DiffHunk
+	}
+	getJSON(t, "/foo/foo.txt.diff.json?from=94b931b4&to=2c355541", &diff)
+	assert.Equal(t, "/foo/foo.txt", diff.Path)
+	if assert.Len(t, diff.Hunks, 1) {
+		lines := diff.Hunks[0].Lines
+		if assert.Len(t, lines, 2) {
+			assert.Equal(t, " ", lines[0].Origin)
+			assert.Equal(t, "+", lines[1].Origin)
+			assert.Equal(t, "yup\n", lines[1].Content)
+			assert.Equal(t, 2, lines[1].NewLine)
+		}
+	}
+}
+
 type putTestCase struct {
 	testTitle    string
 	path         string
@@ -292,6 +496,8 @@ func TestPut(t *testing.T) {
 			"Test 2", 400},
 		{"- Bad Folder 2", "/new folder/../test.txt", []string{},
 			"Test 2", 400},
+		{"- .history forbidden", "/foo.history/test.txt", []string{},
+			"Test", 409},
 	}
 
 	for _, c := range cases {
@@ -328,3 +534,1309 @@ func testPutRequest(t *testing.T, c putTestCase) {
 		testRequest(t, checkCase)
 	}
 }
+
+type deleteTestCase struct {
+	testTitle    string
+	path         string
+	headers      []string
+	responseCode int
+}
+
+func TestDelete(t *testing.T) {
+	cases := []deleteTestCase{
+		{"- not found", "/does-not-exist.md", []string{}, 404},
+		{"- root", "/", []string{}, 409},
+		{"- Last-Id wrong", "/otherfile.txt", []string{"Wiki-Last-Id", "01234abcde"}, 409},
+		{"- Last-Id null", "/otherfile.txt", []string{"Wiki-Last-Id", "null"}, 409},
+		{"+ Last-Id right", "/otherfile.txt", []string{"Wiki-Last-Id", "bfee724db551c19a7735f5a9ed610d4c2bb4da1d"}, 200},
+		{"+ Regular", "/testfile-1.txt", []string{}, 200},
+		{"- already deleted", "/testfile-1.txt", []string{}, 404},
+		{"+ Folder", "/new_folder/", []string{}, 200},
+		{"- Bad Folder", "/foo/../main.md", []string{}, 400},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testTitle, func(t *testing.T) {
+			testDeleteRequest(t, c)
+		})
+	}
+}
+
+// testDeleteRequest calls DELETE on a URL and verifies the response code.
+// On success, the path must not be reachable anymore.
+func testDeleteRequest(t *testing.T, c deleteTestCase) {
+	req, err := http.NewRequest(http.MethodDelete,
+		fmt.Sprintf("http://127.0.0.1:%d%s", port, c.path), nil)
+	assert.NoError(t, err)
+	for i := 0; i < len(c.headers); i += 2 {
+		req.Header.Add(c.headers[i], c.headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bodyB, err := ioutil.ReadAll(resp.Body)
+	body := string(bodyB)
+	assert.NoError(t, err, body)
+
+	assert.Equal(t, c.responseCode, resp.StatusCode, body)
+
+	if c.responseCode == 200 {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", port, c.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+// doRequest sends a request with the given headers and returns the response
+// code and body.
+func doRequest(t *testing.T, method, path string, headers []string,
+	body string) (int, string) {
+	req, err := http.NewRequest(method,
+		fmt.Sprintf("http://127.0.0.1:%d%s", port, path), strings.NewReader(body))
+	assert.NoError(t, err)
+	for i := 0; i < len(headers); i += 2 {
+		req.Header.Add(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bodyB, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return resp.StatusCode, string(bodyB)
+}
+
+// TestAuth enables authentication by committing an auth file, and removes it
+// again at the end.
+func TestAuth(t *testing.T) {
+	authFile := `{"Users": [
+		{"Name": "Admin", "Email": "admin@example.com", "Token": "admin-token", "Admin": true},
+		{"Name": "Editor", "Email": "editor@example.com", "Token": "editor-token"},
+		{"Name": "Importer", "Email": "importer@example.com", "Token": "importer-token",
+			"Trusted": true},
+		{"Name": "Contributor", "Email": "contributor@example.com",
+			"Token": "contributor-token", "ProposeOnly": true}
+	]}`
+
+	var info struct {
+		History []struct {
+			Date   time.Time
+			Author struct{ Name, Email string }
+		}
+	}
+	lastAuthor := func(name, email string, date time.Time) func(t *testing.T) {
+		return func(t *testing.T) {
+			getJSON(t, "/auth-test.md.json", &info)
+			if assert.NotEmpty(t, info.History) {
+				assert.Equal(t, name, info.History[0].Author.Name)
+				assert.Equal(t, email, info.History[0].Author.Email)
+				if !date.IsZero() {
+					assert.True(t, date.Equal(info.History[0].Date))
+				}
+			}
+		}
+	}
+	importDate := time.Date(2010, 1, 2, 3, 4, 5, 0, time.UTC)
+	importHeaders := []string{"Wiki-Author", "Old Author <old@example.com>",
+		"Wiki-Date", importDate.Format(time.RFC3339)}
+
+	cases := []struct {
+		title, method, path, token, body string
+		code                             int
+		headers                          []string
+		check                            func(t *testing.T)
+	}{
+		{title: "- broken auth file", method: "PUT", path: "/.wiki/auth.json",
+			body: "{", code: 409},
+		{title: "+ auth file", method: "PUT", path: "/.wiki/auth.json",
+			body: authFile, code: 200},
+
+		{title: "- no token", method: "PUT", path: "/auth-test.md",
+			body: "auth", code: 401},
+		{title: "- wrong token", method: "PUT", path: "/auth-test.md",
+			token: "nope", body: "auth", code: 401},
+		{title: "+ editor", method: "PUT", path: "/auth-test.md",
+			token: "editor-token", body: "auth", code: 200,
+			check: lastAuthor("Editor", "editor@example.com", time.Time{})},
+		{title: "+ public read", method: "GET", path: "/auth-test.md", code: 200},
+		{title: "- editor writes auth file", method: "PUT", path: "/.wiki/auth.json",
+			token: "editor-token", body: "{}", code: 403},
+		{title: "- editor sets author", method: "PUT", path: "/auth-test.md",
+			token: "editor-token", body: "import", code: 403, headers: importHeaders},
+		{title: "+ importer sets author", method: "PUT", path: "/auth-test.md",
+			token: "importer-token", body: "import", code: 200, headers: importHeaders,
+			check: lastAuthor("Old Author", "old@example.com", importDate)},
+		{title: "- contributor writes", method: "PUT", path: "/auth-test.md",
+			token: "contributor-token", body: "contribution", code: 403},
+		{title: "+ contributor proposes", method: "POST", path: "/.proposals",
+			token: "contributor-token", code: 201, body: `{"Description": "Fix",
+				"Operations": [{"Op": "put", "Path": "/auth-test.md", "Content": "fix"}]}`},
+		{title: "- contributor approves", method: "POST", path: "/.proposals/1/approve",
+			token: "contributor-token", code: 403},
+
+		{title: "- read auth file", method: "GET", path: "/.wiki/auth.json", code: 401},
+		{title: "- editor reads auth file", method: "GET", path: "/.wiki/auth.json",
+			token: "editor-token", code: 403},
+		{title: "- editor reads auth history", method: "GET", path: "/.wiki.history/",
+			token: "editor-token", code: 403},
+		{title: "+ admin reads auth file", method: "GET", path: "/.wiki/auth.json",
+			token: "admin-token", code: 200},
+
+		{title: "- editor removes auth file", method: "DELETE", path: "/.wiki/",
+			token: "editor-token", code: 403},
+		{title: "+ admin removes auth file", method: "DELETE", path: "/.wiki/",
+			token: "admin-token", code: 200},
+		{title: "+ auth disabled again", method: "PUT", path: "/auth-test.md",
+			body: "no auth", code: 200},
+	}
+	for _, c := range cases {
+		headers := c.headers
+		if c.token != "" {
+			headers = append([]string{"Auth", c.token}, headers...)
+		}
+		code, body := doRequest(t, c.method, c.path, headers, c.body)
+		if !assert.Equal(t, c.code, code, c.title+": "+body) {
+			break
+		}
+		if c.check != nil {
+			t.Run(c.title, c.check)
+		}
+	}
+}
+
+// TestConcurrentPut fires parallel PUTs and verifies that every commit ends
+// up in the history.
+func TestConcurrentPut(t *testing.T) {
+	const n = 20
+	type result struct {
+		code int
+		body string
+		err  error
+	}
+	results := make(chan result, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			req, err := http.NewRequest(http.MethodPut,
+				fmt.Sprintf("http://127.0.0.1:%d/concurrent/file-%d.txt", port, i),
+				strings.NewReader(fmt.Sprint("file ", i)))
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			results <- result{resp.StatusCode, string(body), err}
+		}(i)
+	}
+
+	commits := map[string]bool{}
+	for i := 0; i < n; i++ {
+		r := <-results
+		assert.NoError(t, r.err)
+		if assert.Equal(t, http.StatusOK, r.code, r.body) {
+			commits[strings.TrimSpace(r.body)] = true
+		}
+	}
+	assert.Len(t, commits, n)
+
+	var listing struct {
+		Entries []struct{ ID string }
+	}
+	getJSON(t, "/concurrent.history/.json", &listing)
+	history := map[string]bool{}
+	for _, e := range listing.Entries {
+		history[e.ID] = true
+	}
+	assert.Equal(t, commits, history)
+
+	for i := 0; i < n; i++ {
+		testRequest(t, testCase{url: fmt.Sprintf("/concurrent/file-%d.txt", i),
+			expected: fmt.Sprint("file ", i)})
+	}
+}
+
+// TestMerge verifies that PUTs based on an outdated Wiki-Last-Id are merged.
+func TestMerge(t *testing.T) {
+	var info struct{ ID string }
+	base := "a\nb\nc\nd\ne\n"
+	testPutRequest(t, putTestCase{"+ base", "/merge-test.md", nil, base, 200})
+	getJSON(t, "/merge-test.md.json", &info)
+	baseId := info.ID
+
+	testPutRequest(t, putTestCase{"+ change 1", "/merge-test.md",
+		[]string{"Wiki-Last-Id", baseId}, "A\nb\nc\nd\ne\n", 200})
+	testPutRequest(t, putTestCase{"- stale without merge", "/merge-test.md",
+		[]string{"Wiki-Last-Id", baseId}, "a\nb\nc\nd\nE\n", 409})
+
+	code, body := doRequest(t, http.MethodPut, "/merge-test.md",
+		[]string{"Wiki-Last-Id", baseId, "Wiki-Merge", "true"}, "a\nb\nc\nd\nE\n")
+	assert.Equal(t, http.StatusOK, code, body)
+	testRequest(t, testCase{url: "/merge-test.md", expected: "A\nb\nc\nd\nE\n"})
+	getJSON(t, "/merge-test.md.json", &info)
+	mergedId := info.ID
+
+	code, body = doRequest(t, http.MethodPut, "/merge-test.md",
+		[]string{"Wiki-Last-Id", baseId, "Wiki-Merge", "true"}, "X\nb\nc\nd\ne\n")
+	assert.Equal(t, http.StatusConflict, code, body)
+	var conflict struct {
+		Path, BaseID, TheirsID, Base, Theirs, Ours string
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &conflict), body)
+	assert.Equal(t, "/merge-test.md", conflict.Path)
+	assert.Equal(t, baseId, conflict.BaseID)
+	assert.Equal(t, mergedId, conflict.TheirsID)
+	assert.Equal(t, base, conflict.Base)
+	assert.Equal(t, "A\nb\nc\nd\nE\n", conflict.Theirs)
+	assert.Equal(t, "X\nb\nc\nd\ne\n", conflict.Ours)
+	testRequest(t, testCase{url: "/merge-test.md", expected: "A\nb\nc\nd\nE\n"})
+
+	// blobs of other paths cannot be used as base
+	testPutRequest(t, putTestCase{"+ other", "/merge-other.md", nil, "secret\n", 200})
+	getJSON(t, "/merge-other.md.json", &info)
+	code, body = doRequest(t, http.MethodPut, "/merge-test.md",
+		[]string{"Wiki-Last-Id", info.ID, "Wiki-Merge", "true"}, "X\nb\nc\nd\ne\n")
+	assert.Equal(t, http.StatusBadRequest, code, body)
+	assert.NotContains(t, body, "secret")
+}
+
+// TestMove verifies that files and folders can be moved, and that the history
+// follows renamed files.
+func TestMove(t *testing.T) {
+	testPutRequest(t, putTestCase{"+ create", "/move-src.md",
+		[]string{"Wiki-Commit-Msg", "create"}, "moving", 200})
+	testPutRequest(t, putTestCase{"+ edit", "/move-src.md",
+		[]string{"Wiki-Commit-Msg", "edit"}, "moving 2", 200})
+
+	code, body := doRequest(t, "MOVE", "/move-src.md",
+		[]string{"Wiki-Destination", "/moved/dst.md", "Wiki-Commit-Msg", "move"}, "")
+	assert.Equal(t, http.StatusOK, code, body)
+	testRequest(t, testCase{url: "/move-src.md", expected: "404 page not found\n"})
+	testRequest(t, testCase{url: "/moved/dst.md", expected: "moving 2"})
+
+	var info struct {
+		History []struct{ CommitMsg string }
+	}
+	getJSON(t, "/moved/dst.md.json", &info)
+	var messages []string
+	for _, h := range info.History {
+		messages = append(messages, h.CommitMsg)
+	}
+	assert.Equal(t, []string{"move", "edit", "create"}, messages)
+
+	code, body = doRequest(t, "MOVE", "/moved/dst.md",
+		[]string{"Wiki-Destination", "/main.md"}, "")
+	assert.Equal(t, http.StatusConflict, code, body)
+	code, body = doRequest(t, "MOVE", "/moved/",
+		[]string{"Wiki-Destination", "/moved/sub/"}, "")
+	assert.Equal(t, http.StatusConflict, code, body)
+	code, body = doRequest(t, "MOVE", "/nothing-here/",
+		[]string{"Wiki-Destination", "/moved2/"}, "")
+	assert.Equal(t, http.StatusNotFound, code, body)
+
+	code, body = doRequest(t, http.MethodPost, "/moved/?move=/moved2/", nil, "")
+	assert.Equal(t, http.StatusOK, code, body)
+	testRequest(t, testCase{url: "/moved/dst.md", expected: "404 page not found\n"})
+	testRequest(t, testCase{url: "/moved2/dst.md", expected: "moving 2"})
+}
+
+func TestSearch(t *testing.T) {
+	var results api.SearchResults
+	search := func(q string) {
+		code, body := doRequest(t, http.MethodGet, "/.search?q="+q, nil, "")
+		assert.Equal(t, http.StatusOK, code, body)
+		results.Results = nil
+		assert.NoError(t, json.Unmarshal([]byte(body), &results))
+	}
+
+	search("zebracorn")
+	assert.Empty(t, results.Results)
+
+	testPutRequest(t, putTestCase{"+ searchable", "/search/one.md", nil,
+		"# Zebracorns\nThe zebracorn is <rare>.\nnothing here", 200})
+	testPutRequest(t, putTestCase{"+ searchable 2", "/search/two.md", nil,
+		"a zebracorn, and another zebracorn", 200})
+	search("Zebracorn")
+	if assert.Len(t, results.Results, 2) {
+		assert.Equal(t, "/search/two.md", results.Results[0].Path)
+		assert.Equal(t, []string{"The <mark>zebracorn</mark> is &lt;rare&gt;."},
+			results.Results[1].Snippets)
+		var info struct{ ID string }
+		getJSON(t, "/search/one.md.json", &info)
+		assert.Equal(t, info.ID, results.Results[1].ID.String())
+	}
+	search("zebracorn+rare")
+	if assert.Len(t, results.Results, 1) {
+		assert.Equal(t, "/search/one.md", results.Results[0].Path)
+	}
+
+	testPutRequest(t, putTestCase{"+ update", "/search/two.md", nil,
+		"no more unicorns", 200})
+	search("zebracorn")
+	assert.Len(t, results.Results, 1)
+	search("unicorns")
+	assert.Len(t, results.Results, 1)
+
+	code, _ := doRequest(t, http.MethodGet, "/.search", nil, "")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestLinks(t *testing.T) {
+	testPutRequest(t, putTestCase{"+ page a", "/links/a.md", nil,
+		"[b](b.md), [main](/main.md)\n![image](b.png) [web](http://example.com)", 200})
+	testPutRequest(t, putTestCase{"+ page b", "/links/b.md", nil,
+		"[back](a.md#top)\n```\n[code](c.md)\n```\n[ref]: ../main.md", 200})
+	testPutRequest(t, putTestCase{"+ page c", "/links/c.md", nil, "alone", 200})
+
+	var info struct {
+		Backlinks, OutgoingLinks []string
+	}
+	getJSON(t, "/links/a.md.json", &info)
+	assert.Equal(t, []string{"/links/b.md"}, info.Backlinks)
+	assert.Equal(t, []string{"/links/b.md", "/main.md"}, info.OutgoingLinks)
+	getJSON(t, "/links/b.md.json", &info)
+	assert.Equal(t, []string{"/links/a.md"}, info.Backlinks)
+	assert.Equal(t, []string{"/links/a.md", "/main.md"}, info.OutgoingLinks)
+
+	var report struct{ Orphans []string }
+	getJSON(t, "/.links/orphans", &report)
+	assert.Contains(t, report.Orphans, "/links/c.md")
+	assert.NotContains(t, report.Orphans, "/links/a.md")
+	assert.NotContains(t, report.Orphans, "/main.md")
+
+	testDeleteRequest(t, deleteTestCase{"+ delete b", "/links/b.md", nil, 200})
+	info.Backlinks = nil
+	getJSON(t, "/links/a.md.json", &info)
+	assert.Empty(t, info.Backlinks)
+	getJSON(t, "/.links/orphans", &report)
+	assert.Contains(t, report.Orphans, "/links/a.md")
+}
+
+func TestBrokenLinks(t *testing.T) {
+	testPutRequest(t, putTestCase{"+ page", "/broken/a.md", nil,
+		"[ok](/main.md)\n\n[gone](missing.md) [search](/.search?q=x)", 200})
+
+	var report api.BrokenLinksReport
+	getJSON(t, "/.links/broken", &report)
+	var found []api.BrokenLink
+	for _, link := range report.Broken {
+		if link.Source == "/broken/a.md" {
+			found = append(found, link)
+		}
+	}
+	assert.Equal(t, []api.BrokenLink{
+		{Source: "/broken/a.md", Line: 3, Link: "missing.md", Target: "/broken/missing.md"},
+	}, found)
+
+	testPutRequest(t, putTestCase{"+ views", "/broken/views.md", nil,
+		"[h](/main.md.history/) [v](/main.md.history/1-1cc138c) [j](/main.md.json) " +
+			"[d](/main.md.diff) [b](/main.md.blame.json) [f](/foo/.json) [r](/.history/) " +
+			"[c](/.changes.atom)\n[gone](/gone.md.history/)", 200})
+	getJSON(t, "/.links/broken", &report)
+	found = nil
+	for _, link := range report.Broken {
+		if link.Source == "/broken/views.md" {
+			found = append(found, link)
+		}
+	}
+	assert.Equal(t, []api.BrokenLink{
+		{Source: "/broken/views.md", Line: 2, Link: "/gone.md.history/",
+			Target: "/gone.md.history"},
+	}, found)
+
+	testPutRequest(t, putTestCase{"+ fix", "/broken/missing.md", nil, "here", 200})
+	getJSON(t, "/.links/broken", &report)
+	for _, link := range report.Broken {
+		assert.NotEqual(t, "/broken/a.md", link.Source)
+	}
+}
+
+func TestETag(t *testing.T) {
+	get := func(path, ifNoneMatch string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet,
+			fmt.Sprintf("http://127.0.0.1:%d%s", port, path), nil)
+		assert.NoError(t, err)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header.Get("ETag")
+	}
+
+	testPutRequest(t, putTestCase{"+ create", "/etag.md", nil, "version 1", 200})
+	code, tag := get("/etag.md", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Regexp(t, `^"[0-9a-f]{40}"$`, tag)
+	code, _ = get("/etag.md", tag)
+	assert.Equal(t, http.StatusNotModified, code)
+	code, _ = get("/etag.md", `"other", W/`+tag)
+	assert.Equal(t, http.StatusNotModified, code)
+
+	_, jsonTag := get("/etag.md.json", "")
+	assert.NotEqual(t, tag, jsonTag)
+	_, listingTag := get("/", "")
+	code, _ = get("/", listingTag)
+	assert.Equal(t, http.StatusNotModified, code)
+
+	code, body := doRequest(t, http.MethodPut, "/etag.md",
+		[]string{"If-Match", `"0123456789012345678901234567890123456789"`}, "version 2")
+	assert.Equal(t, http.StatusPreconditionFailed, code, body)
+	code, body = doRequest(t, http.MethodPut, "/etag.md",
+		[]string{"If-Match", "W/" + tag}, "version 2")
+	assert.Equal(t, http.StatusPreconditionFailed, code, body)
+	code, body = doRequest(t, http.MethodPut, "/etag.md",
+		[]string{"If-None-Match", "*"}, "version 2")
+	assert.Equal(t, http.StatusPreconditionFailed, code, body)
+	code, body = doRequest(t, http.MethodPut, "/etag.md",
+		[]string{"If-Match", tag}, "version 2")
+	assert.Equal(t, http.StatusOK, code, body)
+
+	code, _ = get("/etag.md", tag)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = get("/etag.md.json", jsonTag)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = get("/", listingTag)
+	assert.Equal(t, http.StatusOK, code)
+
+	code, body = doRequest(t, http.MethodDelete, "/etag.md",
+		[]string{"If-Match", tag}, "")
+	assert.Equal(t, http.StatusPreconditionFailed, code, body)
+	code, body = doRequest(t, http.MethodDelete, "/etag.md",
+		[]string{"If-Match", "*"}, "")
+	assert.Equal(t, http.StatusOK, code, body)
+	code, body = doRequest(t, http.MethodPut, "/etag.md",
+		[]string{"If-Match", "*"}, "version 3")
+	assert.Equal(t, http.StatusPreconditionFailed, code, body)
+
+	// listing tags can be sent back to delete the folder
+	testPutRequest(t, putTestCase{"+ create", "/etag-dir/a.md", nil, "a", 200})
+	_, oldDirTag := get("/etag-dir/", "")
+	testPutRequest(t, putTestCase{"+ change", "/etag-dir/b.md", nil, "b", 200})
+	code, body = doRequest(t, http.MethodDelete, "/etag-dir/",
+		[]string{"If-Match", oldDirTag}, "")
+	assert.Equal(t, http.StatusPreconditionFailed, code, body)
+	_, dirTag := get("/etag-dir/", "")
+	// changes elsewhere do not matter
+	testPutRequest(t, putTestCase{"+ other", "/etag-other.md", nil, "other", 200})
+	code, body = doRequest(t, http.MethodDelete, "/etag-dir/",
+		[]string{"If-Match", dirTag}, "")
+	assert.Equal(t, http.StatusOK, code, body)
+}
+
+func TestContentType(t *testing.T) {
+	request := func(method, path string, headers ...string) (*http.Response, string) {
+		req, err := http.NewRequest(method,
+			fmt.Sprintf("http://127.0.0.1:%d%s", port, path), nil)
+		assert.NoError(t, err)
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp, string(body)
+	}
+
+	resp, _ := request(http.MethodGet, "/main.md")
+	assert.Equal(t, "text/markdown; charset=utf-8", resp.Header.Get("Content-Type"))
+	resp, _ = request(http.MethodGet, "/foo/foo.txt")
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	testPutRequest(t, putTestCase{"+ image", "/image-without-extension", nil,
+		"\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", 200})
+	resp, _ = request(http.MethodGet, "/image-without-extension")
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+
+	resp, body := request(http.MethodGet, "/foo/foo.txt", "Range", "bytes=4-")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "txt\n", body)
+	assert.Equal(t, "bytes 4-7/8", resp.Header.Get("Content-Range"))
+
+	resp, body = request(http.MethodHead, "/foo/foo.txt")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "8", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "", body)
+}
+
+func TestBatch(t *testing.T) {
+	code, body := doRequest(t, http.MethodPost, "/.commit",
+		[]string{"Wiki-Commit-Msg", "batch"}, `{"Operations": [
+		{"Op": "put", "Path": "/batch/a.md", "Content": "A"},
+		{"Op": "put", "Path": "/batch/b.md", "Data": "Qg=="},
+		{"Op": "move", "Path": "/batch/b.md", "Destination": "/batch/c.md"}
+	]}`)
+	assert.Equal(t, http.StatusOK, code, body)
+	commitId := body
+	testRequest(t, testCase{url: "/batch/a.md", expected: "A"})
+	testRequest(t, testCase{url: "/batch/b.md", expected: "404 page not found\n"})
+	testRequest(t, testCase{url: "/batch/c.md", expected: "B"})
+
+	var info struct {
+		History []struct{ CommitMsg string }
+	}
+	getJSON(t, "/batch/.json", &info)
+	if assert.Len(t, info.History, 1) {
+		assert.Equal(t, "batch", info.History[0].CommitMsg)
+	}
+
+	// a failing operation rejects the whole batch
+	code, body = doRequest(t, http.MethodPost, "/.commit", nil, `{"Operations": [
+		{"Op": "put", "Path": "/batch/d.md", "Content": "D"},
+		{"Op": "delete", "Path": "/batch/nothing.md"}
+	]}`)
+	assert.Equal(t, http.StatusNotFound, code, body)
+	assert.Contains(t, body, "operation 2 (delete /batch/nothing.md)")
+	testRequest(t, testCase{url: "/batch/d.md", expected: "404 page not found\n"})
+
+	code, body = doRequest(t, http.MethodPost, "/.commit", nil, `{"Operations": [
+		{"Op": "delete", "Path": "/batch/a.md", "LastId": "0123456789"}
+	]}`)
+	assert.Equal(t, http.StatusConflict, code, body)
+	code, body = doRequest(t, http.MethodPost, "/.commit", nil, `{"Operations": [
+		{"Op": "copy", "Path": "/batch/a.md"}
+	]}`)
+	assert.Equal(t, http.StatusBadRequest, code, body)
+	code, body = doRequest(t, http.MethodPost, "/.commit", nil, `{"Operations": []}`)
+	assert.Equal(t, http.StatusBadRequest, code, body)
+
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	assert.NoError(t, writer.WriteField("operations", `{"Operations": [
+		{"Op": "put", "Path": "/batch/page.md", "Content": "![image](image.bin)"},
+		{"Op": "put", "Path": "/batch/image.bin", "Part": "image"}
+	]}`))
+	part, err := writer.CreateFormFile("image", "image.bin")
+	assert.NoError(t, err)
+	part.Write([]byte{0, 1, 2})
+	assert.NoError(t, writer.Close())
+	code, body = doRequest(t, http.MethodPost, "/.commit",
+		[]string{"Content-Type", writer.FormDataContentType()}, form.String())
+	assert.Equal(t, http.StatusOK, code, body)
+	assert.NotEqual(t, commitId, body)
+	testRequest(t, testCase{url: "/batch/image.bin", expected: "\x00\x01\x02"})
+}
+
+func TestBranches(t *testing.T) {
+	code, body := doRequest(t, http.MethodPut, "/.branches/draft", nil, "")
+	assert.Equal(t, http.StatusCreated, code, body)
+	code, body = doRequest(t, http.MethodPut, "/.branches/draft", nil, "")
+	assert.Equal(t, http.StatusConflict, code, body)
+	code, body = doRequest(t, http.MethodPut, "/.branches/draft2?from=draft", nil, "")
+	assert.Equal(t, http.StatusCreated, code, body)
+
+	var listing struct {
+		Branches []struct {
+			Name string
+			Head bool
+		}
+	}
+	getJSON(t, "/.branches", &listing)
+	assert.Equal(t, 3, len(listing.Branches))
+	for _, branch := range listing.Branches {
+		assert.Equal(t, branch.Name == "master", branch.Head, branch.Name)
+	}
+
+	// writes to the branch do not show up on HEAD
+	code, body = doRequest(t, http.MethodPut, "/branch-test.md?ref=draft", nil, "draft")
+	assert.Equal(t, http.StatusOK, code, body)
+	testRequest(t, testCase{url: "/branch-test.md", expected: "404 page not found\n"})
+	testRequest(t, testCase{url: "/branch-test.md?ref=draft", expected: "draft"})
+	code, body = doRequest(t, http.MethodGet, "/branch-test.md",
+		[]string{"Wiki-Ref", "draft"}, "")
+	assert.Equal(t, "draft", body)
+	code, _ = doRequest(t, http.MethodGet, "/main.md?ref=nothing", nil, "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = doRequest(t, http.MethodPut, "/main.md?ref=nothing", nil, "x")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// fast-forward
+	code, body = doRequest(t, http.MethodPost, "/.branches/draft/merge", nil, "")
+	assert.Equal(t, http.StatusOK, code, body)
+	testRequest(t, testCase{url: "/branch-test.md", expected: "draft"})
+
+	// merge commit
+	code, body = doRequest(t, http.MethodPut, "/branch-test-2.md",
+		[]string{"Wiki-Ref", "draft2"}, "draft2")
+	assert.Equal(t, http.StatusOK, code, body)
+	code, body = doRequest(t, http.MethodPost, "/.branches/draft2/merge",
+		[]string{"Wiki-Commit-Msg", "merge draft2"}, "")
+	assert.Equal(t, http.StatusOK, code, body)
+	testRequest(t, testCase{url: "/branch-test.md", expected: "draft"})
+	testRequest(t, testCase{url: "/branch-test-2.md", expected: "draft2"})
+
+	// conflict
+	code, body = doRequest(t, http.MethodPut, "/branch-test.md?ref=draft", nil, "draft 2")
+	assert.Equal(t, http.StatusOK, code, body)
+	code, body = doRequest(t, http.MethodPut, "/branch-test.md", nil, "master 2")
+	assert.Equal(t, http.StatusOK, code, body)
+	code, body = doRequest(t, http.MethodPost, "/.branches/draft/merge", nil, "")
+	assert.Equal(t, http.StatusConflict, code, body)
+	var conflict struct {
+		Branch    string
+		Conflicts []struct{ Path, Ours, Theirs string }
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &conflict))
+	assert.Equal(t, "draft", conflict.Branch)
+	if assert.Len(t, conflict.Conflicts, 1) {
+		assert.Equal(t, "/branch-test.md", conflict.Conflicts[0].Path)
+		assert.Equal(t, "draft 2", conflict.Conflicts[0].Ours)
+		assert.Equal(t, "master 2", conflict.Conflicts[0].Theirs)
+	}
+	testRequest(t, testCase{url: "/branch-test.md", expected: "master 2"})
+
+	// other references cannot be merged into
+	for _, into := range []string{"refs/proposals/1", "refs/meta/proposals/1", "a/b", "..x"} {
+		code, body = doRequest(t, http.MethodPost, "/.branches/draft2/merge?into="+into, nil, "")
+		assert.Equal(t, http.StatusBadRequest, code, into+": "+body)
+	}
+}
+
+func TestProposals(t *testing.T) {
+	var proposal struct {
+		ID          int
+		Author      struct{ Name, Email string }
+		Description string
+		Status      string
+		Comments    []struct{ Text string }
+	}
+	create := func(description, path, content string) int {
+		code, body := doRequest(t, http.MethodPost, "/.proposals", nil,
+			`{"Description": "`+description+`", "Operations": [
+				{"Op": "put", "Path": "`+path+`", "Content": "`+content+`"}]}`)
+		if !assert.Equal(t, http.StatusCreated, code, body) {
+			t.FailNow()
+		}
+		assert.NoError(t, json.Unmarshal([]byte(body), &proposal))
+		assert.Equal(t, description, proposal.Description)
+		assert.Equal(t, "open", proposal.Status)
+		return proposal.ID
+	}
+
+	// proposals do not change HEAD until approved
+	id := create("New page", "/proposal-test.md", "proposed")
+	url := "/.proposals/" + strconv.Itoa(id)
+	testRequest(t, testCase{url: "/proposal-test.md", expected: "404 page not found\n"})
+	code, body := doRequest(t, http.MethodGet, url+"/diff", nil, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "--- /dev/null\n+++ b/proposal-test.md\n")
+	assert.Contains(t, body, "\n+proposed\n")
+
+	code, body = doRequest(t, http.MethodPost, url+"/comments", nil, "Looks good.")
+	assert.Equal(t, http.StatusCreated, code, body)
+	getJSON(t, url, &proposal)
+	if assert.Len(t, proposal.Comments, 1) {
+		assert.Equal(t, "Looks good.", proposal.Comments[0].Text)
+	}
+
+	code, body = doRequest(t, http.MethodPost, url+"/approve", nil, "")
+	assert.Equal(t, http.StatusOK, code, body)
+	testRequest(t, testCase{url: "/proposal-test.md", expected: "proposed"})
+	getJSON(t, url, &proposal)
+	assert.Equal(t, "approved", proposal.Status)
+	code, body = doRequest(t, http.MethodPost, url+"/approve", nil, "")
+	assert.Equal(t, http.StatusConflict, code, body)
+
+	// merged after HEAD moved on
+	id = create("Change page", "/proposal-test.md", "changed")
+	code, body = doRequest(t, http.MethodPut, "/proposal-other.md", nil, "other")
+	assert.Equal(t, http.StatusOK, code, body)
+	code, body = doRequest(t, http.MethodPost,
+		"/.proposals/"+strconv.Itoa(id)+"/approve", nil, "")
+	assert.Equal(t, http.StatusOK, code, body)
+	testRequest(t, testCase{url: "/proposal-test.md", expected: "changed"})
+	testRequest(t, testCase{url: "/proposal-other.md", expected: "other"})
+
+	// rejected
+	id = create("Vandalism", "/proposal-test.md", "spam")
+	url = "/.proposals/" + strconv.Itoa(id)
+	code, body = doRequest(t, http.MethodPost, url+"/reject", nil, "No, thanks.")
+	assert.Equal(t, http.StatusOK, code, body)
+	code, body = doRequest(t, http.MethodPost, url, nil,
+		`{"Operations": [{"Op": "delete", "Path": "/proposal-test.md"}]}`)
+	assert.Equal(t, http.StatusConflict, code, body)
+	testRequest(t, testCase{url: "/proposal-test.md", expected: "changed"})
+
+	var listing struct {
+		Proposals []struct{ ID int }
+	}
+	getJSON(t, "/.proposals?status=rejected", &listing)
+	if assert.Len(t, listing.Proposals, 1) {
+		assert.Equal(t, id, listing.Proposals[0].ID)
+	}
+	code, _ = doRequest(t, http.MethodGet, "/.proposals/999", nil, "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestWebhooks(t *testing.T) {
+	code, id := doRequest(t, http.MethodPut, "/webhook-test.md",
+		[]string{"Wiki-Commit-Msg", "hook me"}, "hook")
+	if !assert.Equal(t, http.StatusOK, code, id) {
+		return
+	}
+	id = strings.TrimSpace(id)
+
+	var payload struct {
+		Ref, ID, Message string
+		Paths            []string
+	}
+	timeout := time.After(5 * time.Second)
+	for payload.ID != id {
+		select {
+		case req := <-webhookRequests:
+			mac := hmac.New(sha256.New, []byte("hook-secret"))
+			mac.Write(req.body)
+			assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), req.signature)
+			assert.NoError(t, json.Unmarshal(req.body, &payload))
+		case <-timeout:
+			t.Fatal("webhook was not called")
+		}
+	}
+	assert.Equal(t, "refs/heads/master", payload.Ref)
+	assert.Equal(t, "hook me", payload.Message)
+	assert.Equal(t, []string{"/webhook-test.md"}, payload.Paths)
+
+	var deliveryLog struct {
+		Deliveries []struct {
+			Commit, Status string
+			Attempts       []struct{ StatusCode int }
+		}
+	}
+	for i := 0; i < 50; i++ {
+		getJSON(t, "/.webhooks/deliveries", &deliveryLog)
+		if len(deliveryLog.Deliveries) > 0 && deliveryLog.Deliveries[0].Status != "pending" {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if assert.NotEmpty(t, deliveryLog.Deliveries) {
+		assert.Equal(t, id, deliveryLog.Deliveries[0].Commit)
+		assert.Equal(t, "delivered", deliveryLog.Deliveries[0].Status)
+		if assert.Len(t, deliveryLog.Deliveries[0].Attempts, 1) {
+			assert.Equal(t, http.StatusOK, deliveryLog.Deliveries[0].Attempts[0].StatusCode)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/.events?path=/events", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, ": connected\n", line)
+	events := make(chan string, 10)
+	go func() {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				close(events)
+				return
+			}
+			if strings.HasPrefix(line, "data: ") {
+				events <- strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	var event struct {
+		Ref   string
+		Paths []string
+	}
+	next := func() {
+		select {
+		case data := <-events:
+			assert.NoError(t, json.Unmarshal([]byte(data), &event))
+		case <-time.After(10 * time.Second):
+			t.Fatal("no event received")
+		}
+	}
+
+	code, body := doRequest(t, http.MethodPut, "/other.md", nil, "not shown")
+	assert.Equal(t, http.StatusOK, code, body)
+	code, body = doRequest(t, http.MethodPut, "/events/page.md", nil, "event")
+	assert.Equal(t, http.StatusOK, code, body)
+	next()
+	assert.Equal(t, "refs/heads/master", event.Ref)
+	assert.Equal(t, []string{"/events/page.md"}, event.Paths)
+
+	// commit outside the API
+	repo, err := git.OpenRepository(repoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Free()
+	head, err := repo.Head()
+	assert.NoError(t, err)
+	parent, err := repo.LookupCommit(head.Target())
+	assert.NoError(t, err)
+	parentTree, err := parent.Tree()
+	assert.NoError(t, err)
+	builder, err := repo.TreeBuilderFromTree(parentTree)
+	assert.NoError(t, err)
+	blobId, err := repo.CreateBlobFromBuffer([]byte("pushed"))
+	assert.NoError(t, err)
+	assert.NoError(t, builder.Insert("events-pushed.md", blobId, git.FilemodeBlob))
+	treeId, err := builder.Write()
+	assert.NoError(t, err)
+	tree, err := repo.LookupTree(treeId)
+	assert.NoError(t, err)
+	sig := &git.Signature{Name: "Pusher", Email: "pusher@example.com", When: time.Now()}
+	_, err = repo.CreateCommit(head.Name(), sig, sig, "pushed", tree, parent)
+	assert.NoError(t, err)
+
+	next()
+	assert.Equal(t, []string{"/events-pushed.md"}, event.Paths)
+	testRequest(t, testCase{url: "/events-pushed.md", expected: "pushed"})
+}
+
+func TestGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir, err := ioutil.TempDir(os.TempDir(), "gotest-clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	run := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Pusher",
+			"-c", "user.email=pusher@example.com"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatal(strings.Join(args, " "), ": ", err, "\n", string(out))
+		}
+	}
+
+	run("clone", fmt.Sprintf("http://127.0.0.1:%d/.git/", port), "clone")
+	content, err := ioutil.ReadFile(dir + "/clone/main.md")
+	assert.NoError(t, err)
+	code, body := doRequest(t, http.MethodGet, "/main.md", nil, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, body, string(content))
+
+	dir += "/clone"
+	assert.NoError(t, ioutil.WriteFile(dir+"/git-pushed.md", []byte("pushed zebra"), 0644))
+	run("add", "git-pushed.md")
+	run("commit", "-m", "pushed")
+	run("push", "origin", "HEAD")
+
+	testRequest(t, testCase{url: "/git-pushed.md", expected: "pushed zebra"})
+	// the search index was updated
+	var results struct {
+		Results []struct{ Path string }
+	}
+	getJSON(t, "/.search?q=zebra", &results)
+	paths := []string{}
+	for _, result := range results.Results {
+		paths = append(paths, result.Path)
+	}
+	assert.Contains(t, paths, "/git-pushed.md")
+}
+
+// TestGitAuth fetches and pushes as an editor while authentication is
+// enabled.
+func TestGitAuth(t *testing.T) {
+	version, err := exec.Command("git", "version").Output()
+	if err != nil {
+		t.Skip("git not installed")
+	}
+	var major, minor int
+	fmt.Sscanf(string(version), "git version %d.%d", &major, &minor)
+	if major < 2 || major == 2 && minor < 9 {
+		t.Skip("git 2.9 or newer is needed to check pushes")
+	}
+	dir, err := ioutil.TempDir(os.TempDir(), "gotest-clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	run := func(args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Pusher",
+			"-c", "user.email=pusher@example.com"}, args...)...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	url := func(token string) string {
+		if token == "" {
+			return fmt.Sprintf("http://127.0.0.1:%d/.git/", port)
+		}
+		return fmt.Sprintf("http://user:%s@127.0.0.1:%d/.git/", token, port)
+	}
+	hash := func(token string) string {
+		sum := sha256.Sum256([]byte(token))
+		return hex.EncodeToString(sum[:])
+	}
+	admin := []string{"Auth", "git-admin-token"}
+
+	code, body := doRequest(t, http.MethodPut, "/.wiki/auth.json", nil, `{"Users": [
+		{"Name": "Admin", "Email": "admin@example.com", "Token": "git-admin-token", "Admin": true},
+		{"Name": "Editor", "Email": "editor@example.com", "Token": "git-editor-token"}]}`)
+	if !assert.Equal(t, http.StatusOK, code, body) {
+		return
+	}
+	defer func() {
+		code, body := doRequest(t, http.MethodDelete, "/.wiki/", admin, "")
+		assert.Equal(t, http.StatusOK, code, body)
+	}()
+	// the clone would hold the plain tokens
+	out, err := run("clone", url("git-editor-token"), "editor")
+	assert.Error(t, err, out)
+
+	code, body = doRequest(t, http.MethodPut, "/.wiki/auth.json", admin, `{"Users": [
+		{"Name": "Admin", "Email": "admin@example.com", "Admin": true,
+			"TokenSHA256": "`+hash("git-admin-token")+`"},
+		{"Name": "Editor", "Email": "editor@example.com",
+			"TokenSHA256": "`+hash("git-editor-token")+`"},
+		{"Name": "Contributor", "Email": "contributor@example.com", "ProposeOnly": true,
+			"TokenSHA256": "`+hash("git-contributor-token")+`"}]}`)
+	if !assert.Equal(t, http.StatusOK, code, body) {
+		return
+	}
+	// the plain tokens are still in the history, and still valid
+	out, err = run("clone", url("git-editor-token"), "editor")
+	assert.Error(t, err, out)
+	out, err = run("clone", url("git-admin-token"), "admin")
+	if !assert.NoError(t, err, out) {
+		return
+	}
+	dir += "/admin"
+
+	assert.NoError(t, ioutil.WriteFile(dir+"/git-editor.md", []byte("pushed by editor"), 0644))
+	run("add", "git-editor.md")
+	run("commit", "-m", "editor push")
+	out, err = run("push", url(""), "HEAD")
+	assert.Error(t, err, "anonymous push: "+out)
+	out, err = run("push", url("git-contributor-token"), "HEAD")
+	assert.Error(t, err, "contributor push: "+out)
+	out, err = run("push", url("git-editor-token"), "HEAD")
+	assert.NoError(t, err, out)
+	testRequest(t, testCase{url: "/git-editor.md", expected: "pushed by editor"})
+
+	// a merge taking the old auth file from one of its parents
+	out, err = run("log", "-1", "--skip=1", "--format=%H", "--", ".wiki/auth.json")
+	assert.NoError(t, err, out)
+	old := strings.TrimSpace(out)
+	run("checkout", old, "--", ".wiki/auth.json")
+	tree, err := run("write-tree")
+	assert.NoError(t, err, tree)
+	merge, err := run("commit-tree", strings.TrimSpace(tree), "-p", "HEAD", "-p", old,
+		"-m", "merge old auth file")
+	assert.NoError(t, err, merge)
+	out, err = run("push", url("git-editor-token"),
+		strings.TrimSpace(merge)+":refs/heads/old-auth")
+	assert.Error(t, err, "merge push: "+out)
+	run("reset", "--hard", "HEAD")
+
+	assert.NoError(t, ioutil.WriteFile(dir+"/.wiki/auth.json", []byte(`{"Users": [
+		{"Name": "Editor", "Token": "git-editor-token", "Admin": true}]}`), 0644))
+	run("commit", "-a", "-m", "promote myself")
+	out, err = run("push", url("git-editor-token"), "HEAD")
+	assert.Error(t, err, "protected push: "+out)
+	run("reset", "--hard", "HEAD~1")
+	out, err = run("push", "--force", url("git-editor-token"), "HEAD~1:master")
+	assert.Error(t, err, "forced push: "+out)
+	out, err = run("push", url("git-editor-token"), "HEAD:refs/proposals/99")
+	assert.Error(t, err, "push outside branches: "+out)
+
+	code, body = doRequest(t, http.MethodGet, "/.wiki/auth.json", admin, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, hash("git-admin-token"))
+}
+
+func TestMirrors(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	code, id := doRequest(t, http.MethodPut, "/mirror-test.md", nil, "mirrored")
+	if !assert.Equal(t, http.StatusOK, code, id) {
+		return
+	}
+	id = strings.TrimSpace(id)
+
+	var listing struct {
+		Mirrors []struct {
+			URL, LastError string
+			Pushed         string
+			Pending        bool
+		}
+	}
+	for i := 0; i < 100; i++ {
+		getJSON(t, "/.mirrors", &listing)
+		if len(listing.Mirrors) == 1 && listing.Mirrors[0].Pushed == id &&
+			!listing.Mirrors[0].Pending {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !assert.Len(t, listing.Mirrors, 1) {
+		return
+	}
+	status := listing.Mirrors[0]
+	assert.Equal(t, mirrorPath, status.URL)
+	assert.Equal(t, id, status.Pushed, status.LastError)
+	assert.False(t, status.Pending)
+
+	mirror, err := git.OpenRepository(mirrorPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mirror.Free()
+	ref, err := mirror.References.Lookup("refs/heads/master")
+	if assert.NoError(t, err) {
+		assert.Equal(t, id, ref.Target().String())
+	}
+}
+
+func TestRevert(t *testing.T) {
+	put := func(path, content string) string {
+		code, body := doRequest(t, http.MethodPut, path, nil, content)
+		if !assert.Equal(t, http.StatusOK, code, body) {
+			t.FailNow()
+		}
+		return strings.TrimSpace(body)
+	}
+
+	// a single file
+	original := put("/revert-test.md", "original")
+	put("/revert-test.md", "vandalized")
+	code, body := doRequest(t, http.MethodPost, "/revert-test.md.revert?to="+original,
+		nil, "")
+	assert.Equal(t, http.StatusOK, code, body)
+	testRequest(t, testCase{url: "/revert-test.md", expected: "original"})
+	// again, which changes nothing
+	reverted := strings.TrimSpace(body)
+	code, body = doRequest(t, http.MethodPost, "/revert-test.md.revert?to="+original,
+		nil, "")
+	assert.Equal(t, http.StatusOK, code, body)
+	assert.Equal(t, reverted, strings.TrimSpace(body))
+	code, _ = doRequest(t, http.MethodPost, "/revert-test.md.revert?to="+original,
+		[]string{"If-Match", `"deadbeef"`}, "")
+	assert.Equal(t, http.StatusPreconditionFailed, code)
+	code, _ = doRequest(t, http.MethodPost, "/revert-test.md.revert?to=deadbeef", nil, "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// a whole commit
+	code, batch := doRequest(t, http.MethodPost, "/.commit", nil, `{"Operations": [
+		{"Op": "put", "Path": "/revert-a.md", "Content": "a"},
+		{"Op": "put", "Path": "/revert-test.md", "Content": "changed"}]}`)
+	assert.Equal(t, http.StatusOK, code, batch)
+	code, body = doRequest(t, http.MethodPost, "/.revert/"+strings.TrimSpace(batch), nil, "")
+	assert.Equal(t, http.StatusOK, code, body)
+	testRequest(t, testCase{url: "/revert-a.md", expected: "404 page not found\n"})
+	testRequest(t, testCase{url: "/revert-test.md", expected: "original"})
+
+	// files changed since
+	changed := put("/revert-test.md", "changed again")
+	put("/revert-test.md", "and again")
+	code, body = doRequest(t, http.MethodPost, "/.revert/"+changed, nil, "")
+	assert.Equal(t, http.StatusConflict, code, body)
+	var conflict struct {
+		Commit string
+		Paths  []string
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &conflict))
+	assert.Equal(t, changed, conflict.Commit)
+	assert.Equal(t, []string{"/revert-test.md"}, conflict.Paths)
+	testRequest(t, testCase{url: "/revert-test.md", expected: "and again"})
+
+	// to a commit without the file
+	code, body = doRequest(t, http.MethodPost, "/revert-test.md.revert?to=94b931b4", nil, "")
+	assert.Equal(t, http.StatusOK, code, body)
+	testRequest(t, testCase{url: "/revert-test.md", expected: "404 page not found\n"})
+	// again, which changes nothing
+	deleted := strings.TrimSpace(body)
+	code, body = doRequest(t, http.MethodPost, "/revert-test.md.revert?to=94b931b4", nil, "")
+	assert.Equal(t, http.StatusOK, code, body)
+	assert.Equal(t, deleted, strings.TrimSpace(body))
+
+	// an executable, committed outside the API, keeps its mode
+	repo, err := git.OpenRepository(repoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Free()
+	head, err := repo.Head()
+	assert.NoError(t, err)
+	parent, err := repo.LookupCommit(head.Target())
+	assert.NoError(t, err)
+	parentTree, err := parent.Tree()
+	assert.NoError(t, err)
+	builder, err := repo.TreeBuilderFromTree(parentTree)
+	assert.NoError(t, err)
+	blobId, err := repo.CreateBlobFromBuffer([]byte("#!/bin/sh\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, builder.Insert("revert-exec.sh", blobId, git.FilemodeBlobExecutable))
+	treeId, err := builder.Write()
+	assert.NoError(t, err)
+	tree, err := repo.LookupTree(treeId)
+	assert.NoError(t, err)
+	sig := &git.Signature{Name: "Pusher", Email: "pusher@example.com", When: time.Now()}
+	executable, err := repo.CreateCommit(head.Name(), sig, sig, "executable", tree, parent)
+	if !assert.NoError(t, err) {
+		return
+	}
+	put("/revert-exec.sh", "changed")
+	code, body = doRequest(t, http.MethodPost, "/revert-exec.sh.revert?to="+executable.String(),
+		nil, "")
+	assert.Equal(t, http.StatusOK, code, body)
+	revertId, err := git.NewOid(strings.TrimSpace(body))
+	if !assert.NoError(t, err) {
+		return
+	}
+	revertCommit, err := repo.LookupCommit(revertId)
+	if !assert.NoError(t, err) {
+		return
+	}
+	revertedTree, err := revertCommit.Tree()
+	assert.NoError(t, err)
+	entry, err := revertedTree.EntryByPath("revert-exec.sh")
+	if assert.NoError(t, err) {
+		assert.Equal(t, blobId.String(), entry.Id.String())
+		assert.Equal(t, git.FilemodeBlobExecutable, entry.Filemode)
+	}
+}
+
+func TestBlame(t *testing.T) {
+	code, first := doRequest(t, http.MethodPut, "/blame-test.md", nil, "one\ntwo\nthree\n")
+	assert.Equal(t, http.StatusOK, code, first)
+	code, second := doRequest(t, http.MethodPut, "/blame-test.md", nil, "one\n2\nthree\nfour")
+	assert.Equal(t, http.StatusOK, code, second)
+	code, third := doRequest(t, http.MethodPut, "/blame-test.md", nil, "zero\none\n2\nfour")
+	assert.Equal(t, http.StatusOK, code, third)
+	// the lines are still blamed on the commits which changed them
+	code, body := doRequest(t, http.MethodPut, "/blame-other.md", nil, "other")
+	assert.Equal(t, http.StatusOK, code, body)
+
+	var blame struct {
+		Path  string
+		Lines []struct {
+			Line    int
+			Content string
+			ID      string
+		}
+	}
+	getJSON(t, "/blame-test.md.blame.json", &blame)
+	assert.Equal(t, "/blame-test.md", blame.Path)
+	expected := []struct{ content, id string }{
+		{"zero", third}, {"one", first}, {"2", second}, {"four", second}}
+	if assert.Len(t, blame.Lines, len(expected)) {
+		for i, line := range blame.Lines {
+			assert.Equal(t, i+1, line.Line)
+			assert.Equal(t, expected[i].content, line.Content)
+			assert.Equal(t, strings.TrimSpace(expected[i].id), line.ID, line.Content)
+		}
+	}
+	testRequest(t, testCase{url: "/nothing.md.blame.json", expected: "404 page not found\n"})
+
+	// the line of foo.txt is from "moar data", not from a commit still having it
+	getJSON(t, "/foo/foo.txt.blame.json", &blame)
+	if assert.NotEmpty(t, blame.Lines) {
+		assert.Equal(t, "d6e0ace47cad2917af6c17486cc53ab60565c4c7", blame.Lines[0].ID)
+	}
+}
+
+type changesListing struct {
+	Changes []struct {
+		ID     string
+		Author struct{ Name, Email string }
+		Paths  []string
+	}
+	Next string
+}
+
+func TestChanges(t *testing.T) {
+	code, first := doRequest(t, http.MethodPut, "/changes-test/a.md",
+		[]string{"Wiki-Author", "Ada <ada@example.com>"}, "a")
+	assert.Equal(t, http.StatusOK, code, first)
+	code, second := doRequest(t, http.MethodPut, "/changes-test/b.md",
+		[]string{"Wiki-Author", "Bob <bob@example.com>", "Wiki-Commit-Msg", "Add b"}, "b")
+	assert.Equal(t, http.StatusOK, code, second)
+	code, third := doRequest(t, http.MethodPut, "/changes-other.md",
+		[]string{"Wiki-Author", "Ada <ada@example.com>"}, "c")
+	assert.Equal(t, http.StatusOK, code, third)
+	first, second, third = strings.TrimSpace(first), strings.TrimSpace(second),
+		strings.TrimSpace(third)
+
+	var changes changesListing
+	getJSON(t, "/.changes?limit=2", &changes)
+	if assert.Len(t, changes.Changes, 2) {
+		assert.Equal(t, third, changes.Changes[0].ID)
+		assert.Equal(t, []string{"/changes-other.md"}, changes.Changes[0].Paths)
+		assert.Equal(t, second, changes.Changes[1].ID)
+		assert.Equal(t, "Bob", changes.Changes[1].Author.Name)
+	}
+	assert.Equal(t, second, changes.Next)
+
+	changes = changesListing{}
+	getJSON(t, "/.changes?limit=1&before="+second, &changes)
+	if assert.Len(t, changes.Changes, 1) {
+		assert.Equal(t, first, changes.Changes[0].ID)
+		assert.Equal(t, []string{"/changes-test/a.md"}, changes.Changes[0].Paths)
+	}
+
+	changes = changesListing{}
+	getJSON(t, "/.changes?limit=2&path=/changes-test/", &changes)
+	if assert.Len(t, changes.Changes, 2) {
+		assert.Equal(t, second, changes.Changes[0].ID)
+		assert.Equal(t, first, changes.Changes[1].ID)
+	}
+
+	changes = changesListing{}
+	getJSON(t, "/.changes?limit=2&author=ADA@example.com", &changes)
+	if assert.Len(t, changes.Changes, 2) {
+		assert.Equal(t, third, changes.Changes[0].ID)
+		assert.Equal(t, first, changes.Changes[1].ID)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/.changes.atom?author=bob&limit=1", port))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "application/atom+xml", resp.Header.Get("Content-Type"))
+	var feed struct {
+		Title   string `xml:"title"`
+		Entries []struct {
+			Title  string `xml:"title"`
+			ID     string `xml:"id"`
+			Author string `xml:"author>name"`
+		} `xml:"entry"`
+	}
+	assert.NoError(t, xml.NewDecoder(resp.Body).Decode(&feed))
+	assert.Equal(t, "Recent changes", feed.Title)
+	if assert.Len(t, feed.Entries, 1) {
+		assert.Equal(t, "Add b", feed.Entries[0].Title)
+		assert.Equal(t, "urn:git:"+second, feed.Entries[0].ID)
+		assert.Equal(t, "Bob", feed.Entries[0].Author)
+	}
+
+	code, body := doRequest(t, http.MethodGet, "/.changes?limit=0", nil, "")
+	assert.Equal(t, http.StatusBadRequest, code, body)
+	code, body = doRequest(t, http.MethodGet, "/.changes?before=0123456789abcdef", nil, "")
+	assert.Equal(t, http.StatusNotFound, code, body)
+}
@@ -0,0 +1,256 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	git "github.com/libgit2/git2go"
+)
+
+// AuthFile is a file inside the repository which can hold additional users,
+// in the same format as AuthConfig.
+// Everything in its directory can only be read and written by admins.
+const AuthFile = "/.wiki/auth.json"
+
+// protectedPrefix is the name of the directory holding AuthFile.
+const protectedPrefix = ".wiki"
+
+// AuthConfig configures the users allowed to access the wiki.
+// Authentication is disabled as long as no users are configured, neither in
+// the config file nor in AuthFile.
+type AuthConfig struct {
+	// AuthenticatedRead requires a token for read access, too.
+	// By default, everybody may read.
+	AuthenticatedRead bool
+	Users             []User
+}
+
+type User struct {
+	Name, Email string
+	// Token is the secret sent in the Auth header. Instead, TokenSHA256 can
+	// hold the hex-encoded SHA-256 of the token, so that AuthFile does not
+	// contain secrets.
+	Token       string
+	TokenSHA256 string `json:",omitempty"`
+	// Admin users can read and write files in the directory of AuthFile.
+	Admin bool
+	// Trusted users, such as importers, may set the author and date of their
+	// commits with the Wiki-Author and Wiki-Date headers.
+	Trusted bool
+	// ProposeOnly users cannot change the wiki directly. They may only submit
+	// proposals, which a maintainer has to approve, and comment on them.
+	ProposeOnly bool `json:",omitempty"`
+}
+
+type contextKey int
+
+const userKey contextKey = 0
+
+// repoAuth caches the parsed AuthFile, keyed by its blob id.
+var repoAuth struct {
+	sync.Mutex
+	id     *git.Oid
+	config AuthConfig
+}
+
+// matches checks whether token belongs to this user.
+func (u *User) matches(token string) bool {
+	sum := sha256.Sum256([]byte(token))
+	var expected []byte
+	if u.TokenSHA256 != "" {
+		var err error
+		expected, err = hex.DecodeString(u.TokenSHA256)
+		if err != nil {
+			return false
+		}
+	} else if u.Token != "" {
+		userSum := sha256.Sum256([]byte(u.Token))
+		expected = userSum[:]
+	} else {
+		return false
+	}
+	return subtle.ConstantTimeCompare(sum[:], expected) == 1
+}
+
+// currentAuth combines the users from the config file with those from
+// AuthFile in HEAD.
+func currentAuth() (AuthConfig, error) {
+	auth := config.Auth
+
+	tree, err := GetRootTree()
+	if err != nil {
+		// no commits yet
+		return auth, nil
+	}
+	defer tree.Free()
+	entry, err := lookupOld(tree, AuthFile)
+	if err != nil || entry == nil {
+		return auth, err
+	}
+	defer entry.Free()
+
+	repoAuth.Lock()
+	defer repoAuth.Unlock()
+	if repoAuth.id == nil || !repoAuth.id.Equal(entry.Id()) {
+		blob, err := entry.AsBlob()
+		if err != nil {
+			return auth, err
+		}
+		defer blob.Free()
+		var fileAuth AuthConfig
+		if err := json.Unmarshal(blob.Contents(), &fileAuth); err != nil {
+			return auth, err
+		}
+		repoAuth.id = entry.Id()
+		repoAuth.config = fileAuth
+	}
+
+	auth.AuthenticatedRead = auth.AuthenticatedRead ||
+		repoAuth.config.AuthenticatedRead
+	auth.Users = append(append([]User{}, auth.Users...),
+		repoAuth.config.Users...)
+	return auth, nil
+}
+
+// validateAuthFile makes sure that a new AuthFile can be parsed, so that
+// nobody locks themselves out by accident.
+func validateAuthFile(content []byte) error {
+	var auth AuthConfig
+	return json.Unmarshal(content, &auth)
+}
+
+// isProtected checks whether a request path touches the directory of
+// AuthFile, including its history.
+func isProtected(path string) bool {
+	for _, el := range strings.Split(path, "/") {
+		if el == protectedPrefix || strings.HasPrefix(el, protectedPrefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func isWrite(method string) bool {
+	return method != http.MethodGet && method != http.MethodHead &&
+		method != http.MethodOptions
+}
+
+// isWriteRequest checks whether a request may change the wiki. Git clients
+// also fetch with POST requests, only pushes write.
+func isWriteRequest(r *http.Request) bool {
+	if isGitRequest(r) {
+		return isGitPush(r)
+	}
+	return isWrite(r.Method)
+}
+
+// Authenticate wraps a handler so that requests are only passed on if the
+// token in their Auth header permits them.
+// The user is attached to the request, see RequestUser.
+func Authenticate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+		auth, err := currentAuth()
+		Check(err, "reading authentication config", 0)
+		if len(auth.Users) == 0 {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		token := r.Header.Get("Auth")
+		if _, password, ok := r.BasicAuth(); ok && token == "" {
+			// git clients only send basic authentication
+			token = password
+		}
+		var user *User
+		if token != "" {
+			for i := range auth.Users {
+				if auth.Users[i].matches(token) {
+					user = &auth.Users[i]
+					break
+				}
+			}
+			if user == nil {
+				unauthorized(w, r, "Invalid token.")
+				return
+			}
+		}
+
+		adminOnly := isProtected(r.URL.Path)
+		needsUser := isWriteRequest(r) || auth.AuthenticatedRead || adminOnly
+		if user == nil && needsUser {
+			unauthorized(w, r, "Authentication required.")
+			return
+		}
+		if adminOnly && !user.Admin {
+			http.Error(w, "Only admins may access this path.", http.StatusForbidden)
+			return
+		}
+
+		if isWriteRequest(r) && user.ProposeOnly && !isProposalSubmission(r) {
+			http.Error(w, "This user may only submit proposals.", http.StatusForbidden)
+			return
+		}
+
+		if user != nil {
+			r = r.WithContext(context.WithValue(r.Context(), userKey, user))
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request, msg string) {
+	if isGitRequest(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="wiki"`)
+	} else {
+		w.Header().Set("WWW-Authenticate", `Token realm="wiki"`)
+	}
+	http.Error(w, msg, http.StatusUnauthorized)
+}
+
+// RequestUser returns the authenticated user of a request, or nil if
+// authentication is disabled or the request carried no token.
+func RequestUser(r *http.Request) *User {
+	user, _ := r.Context().Value(userKey).(*User)
+	return user
+}
+
+// checkProtectedWrite panics with 403 Forbidden if a write request changes
+// the protected path, but its user is not an admin. Authenticate only checks
+// the request path, so this is needed for other paths like move destinations.
+// Writes only lack a user if authentication is disabled.
+func checkProtectedWrite(r *http.Request, path string) {
+	if user := RequestUser(r); user != nil && !user.Admin && isProtected(path) {
+		panic(HttpError{"Only admins may access " + path + ".", http.StatusForbidden})
+	}
+}
+
+// isAdmin checks whether the user of a request is an admin, which everybody
+// is while authentication is disabled.
+func isAdmin(r *http.Request) bool {
+	if user := RequestUser(r); user != nil {
+		return user.Admin
+	}
+	auth, err := currentAuth()
+	Check(err, "reading authentication config", 0)
+	return len(auth.Users) == 0
+}
+
+// checkAdmin panics unless isAdmin. Unlike Authenticate, it also guards
+// reads.
+func checkAdmin(r *http.Request) {
+	if isAdmin(r) {
+		return
+	}
+	if RequestUser(r) == nil {
+		panic(HttpError{"Authentication required.", http.StatusUnauthorized})
+	}
+	panic(HttpError{"Only admins may access this path.", http.StatusForbidden})
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	git "github.com/libgit2/git2go"
+)
+
+// maxMultipartMemory is the part of a multipart batch kept in memory, the
+// rest is buffered on disk.
+const maxMultipartMemory = 32 << 20
+
+// Operation is one change of a batch commit.
+type Operation struct {
+	// Op is "put", "delete" or "move".
+	Op   string
+	Path string
+	// Destination is the new path for "move".
+	Destination string `json:",omitempty"`
+	// LastId is checked like the Wiki-Last-Id header.
+	LastId string `json:",omitempty"`
+	// Content is the new file content for "put". Binary content can be sent
+	// as Data instead, which is base64-encoded in JSON. In multipart requests,
+	// Part names the form file holding the content.
+	Content string `json:",omitempty"`
+	Data    []byte `json:",omitempty"`
+	Part    string `json:",omitempty"`
+}
+
+type Batch struct {
+	Operations []Operation
+}
+
+// CommitBatch applies all operations to HEAD in a single commit. Each
+// operation sees the changes made by the ones before. If one of them fails,
+// nothing is committed.
+// Like PutFile, the commit id is returned as error with status 200.
+func CommitBatch(ops []Operation, meta CommitMeta) (error, int) {
+	if len(ops) == 0 {
+		return errors.New("No operations given."), http.StatusBadRequest
+	}
+	changes := make([]indexChange, len(ops))
+	for i, op := range ops {
+		change, err, code := op.prepare()
+		if err != nil {
+			return operationError(i, op, err), code
+		}
+		changes[i] = change
+	}
+
+	return changeHead(meta, func(oldRootTree *git.Tree, index *git.Index) (error, int) {
+		tree := oldRootTree
+		for i, change := range changes {
+			if i > 0 {
+				treeId, err := index.WriteTreeTo(repo)
+				if err != nil {
+					return err, 0
+				}
+				if tree, err = repo.LookupTree(treeId); err != nil {
+					return err, 0
+				}
+				defer tree.Free()
+			}
+			if err, code := change(tree, index); err != nil {
+				return operationError(i, ops[i], err), code
+			}
+		}
+		return nil, http.StatusOK
+	})
+}
+
+// prepare checks an operation, and stores the content of a file to be put.
+func (op Operation) prepare() (indexChange, error, int) {
+	path, err := checkPath(op.Path)
+	if err != nil {
+		return nil, err, http.StatusBadRequest
+	}
+	switch strings.ToLower(op.Op) {
+	case "put":
+		content := op.Data
+		if content == nil {
+			content = []byte(op.Content)
+		}
+		blobId, err, code := createFileBlob(path, content)
+		if err != nil {
+			return nil, err, code
+		}
+		return putChange(path, op.LastId, blobId, git.FilemodeBlob, nil), nil, http.StatusOK
+	case "delete":
+		return deleteChange(path, op.LastId), nil, http.StatusOK
+	case "move":
+		destination, err := checkPath(op.Destination)
+		if err != nil {
+			return nil, errors.WithMessage(err, "in destination"), http.StatusBadRequest
+		}
+		return moveChange(path, destination, op.LastId), nil, http.StatusOK
+	default:
+		return nil, errors.New("Unknown operation \"" + op.Op + "\"."),
+			http.StatusBadRequest
+	}
+}
+
+func operationError(i int, op Operation, err error) error {
+	return errors.WithMessage(err, fmt.Sprintf("operation %d (%s %s)", i+1, op.Op, op.Path))
+}
+
+// commitHandler takes a batch as JSON, or as multipart form with the batch in
+// the "operations" field and file contents in further parts.
+func commitHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	var batch Batch
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		Check(r.ParseMultipartForm(maxMultipartMemory), "parsing form", http.StatusBadRequest)
+		err := json.Unmarshal([]byte(r.FormValue("operations")), &batch)
+		Check(err, "parsing operations", http.StatusBadRequest)
+		for i := range batch.Operations {
+			op := &batch.Operations[i]
+			if op.Part == "" {
+				continue
+			}
+			file, _, err := r.FormFile(op.Part)
+			Check(err, "reading part "+op.Part, http.StatusBadRequest)
+			op.Data, err = ioutil.ReadAll(file)
+			file.Close()
+			Check(err, "reading part "+op.Part, http.StatusBadRequest)
+		}
+	} else {
+		err := json.NewDecoder(r.Body).Decode(&batch)
+		Check(err, "parsing operations", http.StatusBadRequest)
+	}
+
+	for _, op := range batch.Operations {
+		checkProtectedWrite(r, op.Path)
+		checkProtectedWrite(r, op.Destination)
+	}
+	meta := requestCommitMeta(r)
+
+	err, code := CommitBatch(batch.Operations, meta)
+	writeResult(w, err, code, false)
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+const blameSuffix = ".blame"
+
+// BlameLine is one line of a file, with the commit which last changed it.
+type BlameLine struct {
+	Line    int
+	Content string
+	ID      *Oid
+	Author  AuthorInfo
+	Date    time.Time
+}
+
+type BlameInfo struct {
+	Path  string
+	ID    *Oid
+	Lines []BlameLine
+}
+
+// serveBlame renders the lines of a file, each with the commit which last
+// changed it, as JSON.
+func serveBlame(ctx *RequestContext, r *http.Request, path string) {
+	object, err := lookupAt(ctx.rootCommit, path)
+	Check(err, "getting path", 0)
+	if object == nil {
+		http.NotFound(ctx.w, r)
+		return
+	}
+	if object.Type() != git.ObjectBlob {
+		http.Error(ctx.w, "Only files can be blamed.", http.StatusBadRequest)
+		return
+	}
+	tag := etag(object.Id().String(), ctx.rootCommit.Id().String(), "blame", "json")
+	if checkNotModified(ctx.w, r, tag) {
+		return
+	}
+
+	blob, err := object.AsBlob()
+	Check(err, "getting blob", 0)
+	if bytes.IndexByte(blob.Contents(), 0) != -1 {
+		http.Error(ctx.w, "Binary files cannot be blamed.", http.StatusBadRequest)
+		return
+	}
+	commitInfos, err := getCommitInfos(ctx.rootCommit, object, path)
+	Check(err, "getting history", 0)
+	info, err := blame(path, blob, commitInfos)
+	Check(err, "computing blame", 0)
+
+	b, err := json.MarshalIndent(info, "", "  ")
+	Check(err, "rendering JSON", http.StatusInternalServerError)
+	ctx.w.Write(b)
+}
+
+// blame attributes each line of blob to the commit which added it. The
+// history is walked back version by version, following the lines of blob
+// through the diffs. The lines added by a version are attributed to the commit
+// which changed the file to it, not to the entry itself, which is just some
+// commit having that version. Lines still left at the oldest version are
+// attributed to the commit which created it.
+func blame(path string, blob *git.Blob, history []CommitInfo) (*BlameInfo, error) {
+	history, err := changeCommits(history)
+	if err != nil {
+		return nil, err
+	}
+	lines := splitLines(blob.Contents())
+	info := &BlameInfo{
+		Path:  path,
+		ID:    (*Oid)(blob.Id()),
+		Lines: make([]BlameLine, len(lines))}
+	for i, line := range lines {
+		info.Lines[i] = BlameLine{Line: i + 1, Content: line}
+	}
+	attribute := func(line int, commit CommitInfo) {
+		info.Lines[line].ID = commit.ID
+		info.Lines[line].Author = commit.Author
+		info.Lines[line].Date = commit.Date
+	}
+
+	// lineOf maps the lines of the version being looked at to the lines of
+	// blob, -1 for lines which are not in blob anymore.
+	lineOf := make([]int, len(lines))
+	for i := range lineOf {
+		lineOf[i] = i
+	}
+	newer := blob
+	for i, commit := range history {
+		if i == len(history)-1 {
+			for _, line := range lineOf {
+				if line >= 0 {
+					attribute(line, commit)
+				}
+			}
+			break
+		}
+		older, err := repo.LookupBlob(history[i+1].fileId)
+		if err != nil {
+			return nil, err
+		}
+		added, deleted, err := diffLineNumbers(older, newer)
+		if err != nil {
+			older.Free()
+			return nil, err
+		}
+
+		olderLineOf := make([]int, 0, len(lineOf))
+		for newLine, line := range lineOf {
+			if added[newLine+1] {
+				if line >= 0 {
+					attribute(line, commit)
+				}
+				continue
+			}
+			for deleted[len(olderLineOf)+1] {
+				olderLineOf = append(olderLineOf, -1)
+			}
+			olderLineOf = append(olderLineOf, line)
+		}
+		if newer != blob {
+			newer.Free()
+		}
+		newer, lineOf = older, olderLineOf
+	}
+	if newer != blob {
+		newer.Free()
+	}
+	return info, nil
+}
+
+// changeCommits replaces each entry of a history with the commit which
+// changed the file to its version, where it is known.
+func changeCommits(history []CommitInfo) ([]CommitInfo, error) {
+	changes := make([]CommitInfo, len(history))
+	for i, entry := range history {
+		if entry.changedBy == nil || entry.changedBy.Equal((*git.Oid)(entry.ID)) {
+			changes[i] = entry
+			continue
+		}
+		commit, err := repo.LookupCommit(entry.changedBy)
+		if err != nil {
+			return nil, err
+		}
+		changes[i] = newCommitInfo(commit, entry.fileId)
+		commit.Free()
+	}
+	return changes, nil
+}
+
+// diffLineNumbers returns the numbers of the lines added to newer, and those
+// deleted from older, counted from 1.
+func diffLineNumbers(older, newer *git.Blob) (added, deleted map[int]bool, err error) {
+	opts, err := git.DefaultDiffOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+	opts.ContextLines = 0
+	added, deleted = map[int]bool{}, map[int]bool{}
+	onLine := func(line git.DiffLine) error {
+		switch line.Origin {
+		case git.DiffLineAddition:
+			added[line.NewLineno] = true
+		case git.DiffLineDeletion:
+			deleted[line.OldLineno] = true
+		}
+		return nil
+	}
+	onHunk := func(git.DiffHunk) (git.DiffForEachLineCallback, error) {
+		return onLine, nil
+	}
+	onFile := func(git.DiffDelta, float64) (git.DiffForEachHunkCallback, error) {
+		return onHunk, nil
+	}
+	err = git.DiffBlobs(older, "", newer, "", &opts, onFile, git.DiffDetailLines)
+	return added, deleted, err
+}
+
+// splitLines splits content into lines, without line endings.
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return []string{}
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
@@ -0,0 +1,345 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	git "github.com/libgit2/git2go"
+)
+
+type BranchInfo struct {
+	Name string
+	ID   *Oid
+	// Head is set for the branch HEAD refers to, the main branch.
+	Head bool
+}
+
+type BranchListing struct {
+	Branches []BranchInfo
+}
+
+// BranchConflict is returned by MergeBranch if the changes on the branches
+// conflict. In each MergeConflict, Theirs is the file on Into and Ours the
+// file on Branch.
+type BranchConflict struct {
+	Branch, Into string
+	Conflicts    []MergeConflict
+}
+
+func (c *BranchConflict) Error() string {
+	paths := make([]string, 0, len(c.Conflicts))
+	for _, conflict := range c.Conflicts {
+		paths = append(paths, conflict.Path)
+	}
+	return "Merge conflict in " + strings.Join(paths, ", ")
+}
+
+// requestBranch returns the branch a request works on, given by the "ref"
+// parameter or the Wiki-Ref header. It is empty for the branch HEAD refers to.
+// Requests for branches which do not exist are answered with 404 Not Found.
+func requestBranch(r *http.Request) string {
+	branch := r.URL.Query().Get("ref")
+	if branch == "" {
+		branch = r.Header.Get("Wiki-Ref")
+	}
+	branch = strings.TrimPrefix(branch, branchPrefix)
+	if branch == "" {
+		return ""
+	}
+	if _, err := branchRef(branch); err != nil {
+		panic(HttpError{err.Error(), http.StatusBadRequest})
+	}
+	if _, err := repo.References.Lookup(branchPrefix + branch); isNotFound(err) {
+		panic(HttpError{errNoBranch.Error(), http.StatusNotFound})
+	} else {
+		Check(err, "getting branch", 0)
+	}
+	return branch
+}
+
+// ListBranches returns all local branches, sorted by name.
+func ListBranches() ([]BranchInfo, error) {
+	iter, err := repo.NewBranchIterator(git.BranchLocal)
+	if err != nil {
+		return nil, err
+	}
+	branches := []BranchInfo{}
+	err = iter.ForEach(func(branch *git.Branch, _ git.BranchType) error {
+		name, err := branch.Name()
+		if err != nil {
+			return err
+		}
+		isHead, err := branch.IsHead()
+		if err != nil {
+			return err
+		}
+		branches = append(branches, BranchInfo{name, (*Oid)(branch.Target()), isHead})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byBranchName(branches))
+	return branches, nil
+}
+
+type byBranchName []BranchInfo
+
+func (b byBranchName) Len() int           { return len(b) }
+func (b byBranchName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byBranchName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+
+// CreateBranch creates branch at the revision from, which can be a branch
+// name or a commit id. An empty from means HEAD.
+// Like PutFile, the commit id is returned as error with status 200.
+func CreateBranch(branch, from string) (error, int) {
+	if err := checkBranchName(branch); err != nil {
+		return err, http.StatusBadRequest
+	}
+	commit, err := GetBranchCommit(from)
+	if err == errNoBranch {
+		commit, err = LookupRevision(from)
+	}
+	if err == ErrorNotFound || isNotFound(err) {
+		return errors.New("Revision not found: " + from), http.StatusNotFound
+	}
+	if err != nil {
+		return err, 0
+	}
+	defer commit.Free()
+
+	_, err = repo.CreateBranch(branch, commit, false)
+	if gitErr, ok := err.(*git.GitError); ok && gitErr.Code == git.ErrExists {
+		return errors.New("Branch exists."), http.StatusConflict
+	}
+	if err != nil {
+		return err, 0
+	}
+	return errors.New(commit.Id().String()), http.StatusOK
+}
+
+// checkBranchName checks that a branch given by a client is a plain branch
+// name, and not a full reference name like refs/proposals/1, which would
+// give access to references not meant to be written directly.
+func checkBranchName(branch string) error {
+	if _, err := branchRef(branch); err != nil || strings.Contains(branch, "/") {
+		return errors.New("Invalid branch name: " + branch)
+	}
+	return nil
+}
+
+// MergeBranch merges branch into the branch into, which is the one HEAD
+// refers to if empty. Conflicts are returned as *BranchConflict.
+// Like PutFile, the commit id is returned as error with status 200.
+func MergeBranch(branch, into string, meta CommitMeta) (error, int) {
+	if branch == into {
+		return errors.New("Cannot merge a branch into itself."), http.StatusConflict
+	}
+	if _, err := branchRef(into); err != nil {
+		return err, http.StatusBadRequest
+	}
+	if meta.Message == "" {
+		meta.Message = "Merge branch '" + branch + "'"
+	}
+	meta.Branch = into
+
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	source, err := GetBranchCommit(branch)
+	if err == errNoBranch {
+		return err, http.StatusNotFound
+	} else if err != nil {
+		return err, 0
+	}
+	defer source.Free()
+	targets, targetTree, err := readBranch(into)
+	if err == errNoBranch {
+		return err, http.StatusNotFound
+	} else if err != nil {
+		return err, 0
+	}
+	defer freeCommits(targets)
+	if targetTree == nil {
+		return errors.New("No commit exists."), http.StatusNotFound
+	}
+	defer targetTree.Free()
+	target := targets[0]
+
+	baseId, err := repo.MergeBase(source.Id(), target.Id())
+	if isNotFound(err) {
+		return errors.New("The branches have no common history."), http.StatusConflict
+	} else if err != nil {
+		return err, 0
+	}
+
+	var commitId *git.Oid
+	switch {
+	case baseId.Equal(source.Id()):
+		// nothing to merge
+		return errors.New(target.Id().String()), http.StatusOK
+	case baseId.Equal(target.Id()):
+		err = updateBranch(into, source.Id(), targets, "merge "+branch+": Fast-forward")
+		commitId = source.Id()
+	default:
+		commitId, err = mergeCommits(branch, into, baseId, target, targetTree, source, meta)
+	}
+	if err == errHeadMoved {
+		return errors.New("HEAD was modified concurrently, please retry."),
+			http.StatusConflict
+	}
+	if _, ok := err.(*BranchConflict); ok {
+		return err, http.StatusConflict
+	}
+	if err != nil {
+		return err, 0
+	}
+	runCommitHooks(into, commitId)
+	return errors.New(commitId.String()), http.StatusOK
+}
+
+// mergeCommits creates a merge commit of source on top of target.
+func mergeCommits(branch, into string, baseId *git.Oid, target *git.Commit,
+	targetTree *git.Tree, source *git.Commit, meta CommitMeta) (*git.Oid, error) {
+
+	base, err := repo.LookupCommit(baseId)
+	if err != nil {
+		return nil, err
+	}
+	defer base.Free()
+	baseTree, err := GetCommitTree(base)
+	if err != nil {
+		return nil, err
+	}
+	defer baseTree.Free()
+	sourceTree, err := GetCommitTree(source)
+	if err != nil {
+		return nil, err
+	}
+	defer sourceTree.Free()
+
+	index, err := repo.MergeTrees(baseTree, targetTree, sourceTree, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Free()
+	if index.HasConflicts() {
+		conflicts, err := indexConflicts(index)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &BranchConflict{branch, into, conflicts}
+	}
+	return commitIndex(index, meta, []*git.Commit{target, source})
+}
+
+// indexConflicts describes the conflicts of a merged index, which holds the
+// target branch as "our" side.
+func indexConflicts(index *git.Index) ([]MergeConflict, error) {
+	iter, err := index.ConflictIterator()
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Free()
+
+	conflicts := []MergeConflict{}
+	for {
+		entry, err := iter.Next()
+		if gitErr, ok := err.(*git.GitError); ok && gitErr.Code == git.ErrIterOver {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var path string
+		contents := make([][]byte, 3)
+		ids := make([]*Oid, 3)
+		for i, side := range []*git.IndexEntry{entry.Ancestor, entry.Their, entry.Our} {
+			if side == nil {
+				continue
+			}
+			path = "/" + side.Path
+			ids[i] = (*Oid)(side.Id)
+			blob, err := repo.LookupBlob(side.Id)
+			if err != nil {
+				return nil, err
+			}
+			contents[i] = blob.Contents()
+			blob.Free()
+		}
+
+		input := func(contents []byte) git.MergeFileInput {
+			return git.MergeFileInput{
+				Path:     path[1:],
+				Mode:     uint(git.FilemodeBlob),
+				Contents: contents}
+		}
+		merged, err := git.MergeFile(input(contents[0]), input(contents[1]),
+			input(contents[2]), &git.MergeFileOptions{
+				AncestorLabel: "base",
+				OurLabel:      "ours",
+				TheirLabel:    "theirs"})
+		if err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, MergeConflict{
+			Path:     path,
+			BaseID:   ids[0],
+			TheirsID: ids[2],
+			Base:     string(contents[0]),
+			Ours:     string(contents[1]),
+			Theirs:   string(contents[2]),
+			Merged:   string(merged.Contents)})
+		merged.Free()
+	}
+	return conflicts, nil
+}
+
+func branchesHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	branches, err := ListBranches()
+	Check(err, "listing branches", 0)
+	b, err := json.MarshalIndent(&BranchListing{branches}, "", "  ")
+	Check(err, "rendering JSON", http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func createBranchHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	err, code := CreateBranch(p.ByName("name"), r.URL.Query().Get("from"))
+	if code == http.StatusOK {
+		code = http.StatusCreated
+	}
+	writeResult(w, err, code, false)
+}
+
+func mergeBranchHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	meta := requestCommitMeta(r)
+	into := strings.TrimPrefix(r.URL.Query().Get("into"), branchPrefix)
+	for _, branch := range []string{p.ByName("name"), into} {
+		if branch != "" {
+			Check(checkBranchName(branch), "in branch", http.StatusBadRequest)
+		}
+	}
+	err, code := MergeBranch(p.ByName("name"), into, meta)
+	if conflict, ok := err.(*BranchConflict); ok {
+		b, err := json.MarshalIndent(conflict, "", "  ")
+		Check(err, "rendering JSON", http.StatusInternalServerError)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		w.Write(b)
+		return
+	}
+	writeResult(w, err, code, false)
+}
@@ -0,0 +1,291 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	git "github.com/libgit2/git2go"
+)
+
+// changeIndexFile is the file in the git directory the change index is saved
+// in. Each line holds the JSON of a changeRecord. Records are only appended,
+// parents before their children.
+const changeIndexFile = "wiki-changes"
+
+// changeRecord lists the paths a commit changed compared to its first parent,
+// with their new versions. Folders are included, the root folder as "".
+// Deleted paths are left out.
+type changeRecord struct {
+	ID     *Oid
+	Parent *Oid `json:",omitempty"`
+	Paths  map[string]*Oid
+}
+
+// changeNode is an indexed commit, linked to its first parent.
+type changeNode struct {
+	id     git.Oid
+	parent *changeNode
+	// jump points further back in the history, so that the ancestor at any
+	// depth is found in a logarithmic number of steps.
+	jump *changeNode
+	// depth is the length of the first-parent history before the commit.
+	depth int
+}
+
+func newChangeNode(id git.Oid, parent *changeNode) *changeNode {
+	node := &changeNode{id: id, parent: parent}
+	if parent == nil {
+		node.jump = node
+		return node
+	}
+	node.depth = parent.depth + 1
+	node.jump = parent
+	if j := parent.jump; parent.depth-j.depth == j.depth-j.jump.depth {
+		node.jump = j.jump
+	}
+	return node
+}
+
+// ancestor returns the first-parent ancestor of node at depth.
+func (node *changeNode) ancestor(depth int) *changeNode {
+	for node.depth > depth {
+		if node.jump.depth >= depth {
+			node = node.jump
+		} else {
+			node = node.parent
+		}
+	}
+	return node
+}
+
+type versionKey struct {
+	path string
+	id   git.Oid
+}
+
+// changeIndex maps each version of a path to the commits which changed the
+// path to it. The history of a path can then be followed from change to
+// change, without looking at the commits in between.
+type changeIndex struct {
+	sync.Mutex
+	loaded   bool
+	nodes    map[git.Oid]*changeNode
+	versions map[versionKey][]*changeNode
+	// file is where new records are appended, nil if they cannot be saved.
+	file *os.File
+}
+
+var changeIdx = &changeIndex{}
+
+func init() {
+	OnCommit(func(ref string, commit *git.Commit) {
+		changeIdx.Lock()
+		defer changeIdx.Unlock()
+		if !changeIdx.loaded {
+			// not loaded yet, will be brought up to date on the first use
+			return
+		}
+		if _, err := changeIdx.index(commit.Id()); err != nil {
+			log.Println("updating change index:", err)
+		}
+	})
+}
+
+// load reads the saved index. A broken record, like one only partly written,
+// is cut off along with all following records; they are indexed again when
+// needed.
+// The caller must hold the lock.
+func (idx *changeIndex) load() {
+	if idx.loaded {
+		return
+	}
+	idx.loaded = true
+	idx.nodes = map[git.Oid]*changeNode{}
+	idx.versions = map[versionKey][]*changeNode{}
+
+	file, err := os.OpenFile(filepath.Join(repo.Path(), changeIndexFile),
+		os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		log.Println("change index will not be saved:", err)
+		return
+	}
+	reader := bufio.NewReader(file)
+	var size int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		var record changeRecord
+		if err == nil {
+			err = json.Unmarshal(line, &record)
+		}
+		if err == nil && !idx.add(&record) {
+			err = errors.New("invalid record")
+		}
+		if err != nil {
+			log.Printf("change index: dropping records from offset %d: %v\n", size, err)
+			break
+		}
+		size += int64(len(line))
+	}
+	if err := file.Truncate(size); err != nil {
+		log.Println("change index will not be saved:", err)
+		file.Close()
+		return
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		log.Println("change index will not be saved:", err)
+		file.Close()
+		return
+	}
+	idx.file = file
+}
+
+// add adds a record to the index. It fails if the record is incomplete, or
+// the parent of the commit is not indexed.
+// The caller must hold the lock.
+func (idx *changeIndex) add(record *changeRecord) bool {
+	if record.ID == nil {
+		return false
+	}
+	for _, version := range record.Paths {
+		if version == nil {
+			return false
+		}
+	}
+	id := git.Oid(*record.ID)
+	if idx.nodes[id] != nil {
+		return true
+	}
+	var parent *changeNode
+	if record.Parent != nil {
+		if parent = idx.nodes[git.Oid(*record.Parent)]; parent == nil {
+			return false
+		}
+	}
+	node := newChangeNode(id, parent)
+	idx.nodes[id] = node
+	for p, version := range record.Paths {
+		key := versionKey{p, git.Oid(*version)}
+		idx.versions[key] = append(idx.versions[key], node)
+	}
+	return true
+}
+
+// index adds the commit id and its first-parent ancestors to the index, and
+// returns its node. Only commits not indexed yet are read.
+// The caller must hold the lock.
+func (idx *changeIndex) index(id *git.Oid) (*changeNode, error) {
+	idx.load()
+	var missing []git.Oid
+	for next := id; next != nil && idx.nodes[*next] == nil; {
+		commit, err := repo.LookupCommit(next)
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, *next)
+		next = commit.ParentId(0)
+		commit.Free()
+	}
+
+	var writer *bufio.Writer
+	if idx.file != nil && len(missing) > 0 {
+		writer = bufio.NewWriter(idx.file)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		record, err := newChangeRecord(&missing[i])
+		if err != nil {
+			return nil, err
+		}
+		idx.add(record)
+		if writer != nil {
+			b, err := json.Marshal(record)
+			if err != nil {
+				return nil, err
+			}
+			writer.Write(append(b, '\n'))
+		}
+	}
+	if writer != nil {
+		if err := writer.Flush(); err != nil {
+			log.Println("change index will not be saved:", err)
+			idx.file.Close()
+			idx.file = nil
+		}
+	}
+	return idx.nodes[*id], nil
+}
+
+// newChangeRecord lists the changes made by the commit id.
+func newChangeRecord(id *git.Oid) (*changeRecord, error) {
+	commit, err := repo.LookupCommit(id)
+	if err != nil {
+		return nil, err
+	}
+	defer commit.Free()
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+	record := &changeRecord{
+		ID:    (*Oid)(id),
+		Paths: map[string]*Oid{"": (*Oid)(tree.Id())}}
+	var parentTreeId *git.Oid
+	if parent := commit.Parent(0); parent != nil {
+		record.Parent = (*Oid)(parent.Id())
+		parentTreeId = parent.TreeId()
+		parent.Free()
+	}
+	deltas, err := changedFiles(parentTreeId, tree)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := map[string]bool{}
+	for _, delta := range deltas {
+		if delta.Status != git.DeltaDeleted {
+			record.Paths[delta.NewFile.Path] = (*Oid)(delta.NewFile.Oid)
+		}
+		for _, p := range []string{delta.OldFile.Path, delta.NewFile.Path} {
+			for dir := path.Dir(p); dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+				dirs[dir] = true
+			}
+		}
+	}
+	for dir := range dirs {
+		entry, err := tree.EntryByPath(dir)
+		if isNotFound(err) {
+			// deleted
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		record.Paths[dir] = (*Oid)(entry.Id)
+	}
+	return record, nil
+}
+
+// lastChange returns the newest of node and its first-parent ancestors which
+// changed path to the version id, nil if there is none.
+// The caller must hold the lock.
+func (idx *changeIndex) lastChange(node *changeNode, path string, id *git.Oid) *changeNode {
+	var last *changeNode
+	for _, change := range idx.versions[versionKey{path, *id}] {
+		if change.depth <= node.depth && (last == nil || change.depth > last.depth) &&
+			node.ancestor(change.depth) == change {
+			last = change
+		}
+	}
+	return last
+}
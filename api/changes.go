@@ -0,0 +1,237 @@
+package api
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	git "github.com/libgit2/git2go"
+)
+
+const (
+	// defaultChangesLimit is the number of commits listed by default,
+	// maxChangesLimit the most listed at once.
+	defaultChangesLimit = 50
+	maxChangesLimit     = 500
+	// maxChangesScanned bounds the commits looked at for one page, so that
+	// filters matching nothing do not walk all of the history.
+	maxChangesScanned = 10000
+)
+
+// ChangesListing is a page of the history, newest commit first.
+type ChangesListing struct {
+	Changes []*CommitEvent
+	// Next is passed as "before" to get the following page. It is missing
+	// on the last page.
+	Next *Oid `json:",omitempty"`
+}
+
+// changesFilter selects the commits listed by /.changes.
+type changesFilter struct {
+	// prefix selects the changes to paths starting with it.
+	prefix string
+	// author matches the name or email of the author, ignoring case.
+	author        string
+	showProtected bool
+}
+
+func (f *changesFilter) matches(event *CommitEvent) bool {
+	if f.author != "" && !strings.EqualFold(event.Author.Name, f.author) &&
+		!strings.EqualFold(event.Author.Email, f.author) {
+		return false
+	}
+	event.Paths = filterPaths(event, f.prefix, f.showProtected)
+	return len(event.Paths) > 0
+}
+
+// ListChanges walks the first-parent history of branch, or of HEAD if branch
+// is empty, and returns up to limit commits matching filter. If before is
+// given, the walk starts at the parent of that commit.
+func ListChanges(branch, before string, limit int, filter changesFilter) (*ChangesListing, error, int) {
+	ref := branchPrefix + branch
+	var start *git.Commit
+	var err error
+	if branch == "" {
+		head, err := repo.Head()
+		if err != nil {
+			return nil, err, 0
+		}
+		ref = head.Name()
+		head.Free()
+	}
+	if before != "" {
+		var code int
+		if start, err, code = resolveRevision(before); err != nil {
+			return nil, err, code
+		}
+	} else if start, err = GetBranchCommit(branch); err != nil {
+		return nil, err, 0
+	}
+	defer start.Free()
+
+	listing := &ChangesListing{Changes: []*CommitEvent{}}
+	walk, err := repo.Walk()
+	if err != nil {
+		return nil, err, 0
+	}
+	defer walk.Free()
+	walk.Sorting(git.SortTime | git.SortTopological)
+	walk.SimplifyFirstParent()
+	if before != "" {
+		parent := start.Parent(0)
+		if parent == nil {
+			return listing, nil, http.StatusOK
+		}
+		err = walk.Push(parent.Id())
+		parent.Free()
+	} else {
+		err = walk.Push(start.Id())
+	}
+	if err != nil {
+		return nil, err, 0
+	}
+
+	var id git.Oid
+	var lastScanned *Oid
+	for scanned := 0; walk.Next(&id) == nil; scanned++ {
+		if len(listing.Changes) == limit || scanned == maxChangesScanned {
+			// there is more: continue after the last commit looked at
+			listing.Next = lastScanned
+			break
+		}
+		commit, err := repo.LookupCommit(&id)
+		if err != nil {
+			return nil, err, 0
+		}
+		event, err := newCommitEvent(ref, commit)
+		commit.Free()
+		if err != nil {
+			return nil, err, 0
+		}
+		lastScanned = event.ID
+		if filter.matches(event) {
+			listing.Changes = append(listing.Changes, event)
+		}
+	}
+	return listing, nil, http.StatusOK
+}
+
+// requestChanges lists the changes selected by the parameters of r.
+func requestChanges(r *http.Request) *ChangesListing {
+	query := r.URL.Query()
+	limit := defaultChangesLimit
+	if s := query.Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		Check(err, "parsing limit", http.StatusBadRequest)
+		if limit < 1 || limit > maxChangesLimit {
+			panic(HttpError{"limit must be between 1 and " +
+				strconv.Itoa(maxChangesLimit) + ".", http.StatusBadRequest})
+		}
+	}
+	filter := changesFilter{
+		prefix:        query.Get("path"),
+		author:        query.Get("author"),
+		showProtected: isAdmin(r)}
+	if filter.prefix != "" && !strings.HasPrefix(filter.prefix, "/") {
+		filter.prefix = "/" + filter.prefix
+	}
+
+	listing, err, code := ListChanges(requestBranch(r), query.Get("before"), limit, filter)
+	if err != nil {
+		if code == 0 {
+			code = http.StatusInternalServerError
+		}
+		panic(HttpError{err.Error(), code})
+	}
+	return listing
+}
+
+// changesHandler serves GET /.changes?before=954abcf2&limit=20.
+func changesHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	listing := requestChanges(r)
+	b, err := json.MarshalIndent(listing, "", "  ")
+	Check(err, "rendering JSON", http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomAuthor struct {
+	Name  string `xml:"name"`
+	Email string `xml:"email,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string     `xml:"title"`
+	ID      string     `xml:"id"`
+	Updated string     `xml:"updated"`
+	Author  atomAuthor `xml:"author"`
+	Link    atomLink   `xml:"link"`
+	Summary string     `xml:"summary"`
+}
+
+// baseURL returns the scheme and host the request was sent to.
+func baseURL(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+// changesAtomHandler serves the changes as an Atom feed. The entries link to
+// the root folder at each commit.
+func changesAtomHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	listing := requestChanges(r)
+	base := baseURL(r)
+	feed := atomFeed{
+		Title:   "Recent changes",
+		ID:      base + r.URL.RequestURI(),
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Links:   []atomLink{{"self", base + r.URL.RequestURI()}},
+		Entries: make([]atomEntry, 0, len(listing.Changes))}
+	if len(listing.Changes) > 0 {
+		feed.Updated = listing.Changes[0].Date.UTC().Format(time.RFC3339)
+	}
+	for _, change := range listing.Changes {
+		title := strings.SplitN(strings.TrimSpace(change.Message), "\n", 2)[0]
+		if title == "" {
+			title = "Changed " + strings.Join(change.Paths, ", ")
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   title,
+			ID:      "urn:git:" + change.ID.String(),
+			Updated: change.Date.UTC().Format(time.RFC3339),
+			Author:  atomAuthor{change.Author.Name, change.Author.Email},
+			Link:    atomLink{"alternate", base + "/.history/" + change.ID.String() + "/"},
+			Summary: strings.TrimSpace(change.Message) + "\n\n" + strings.Join(change.Paths, "\n")})
+	}
+
+	b, err := xml.MarshalIndent(&feed, "", "  ")
+	Check(err, "rendering XML", http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/atom+xml")
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+}
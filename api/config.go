@@ -0,0 +1,34 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// Config holds the server configuration. See LoadConfig.
+type Config struct {
+	Auth AuthConfig
+	// Webhooks are notified after each commit.
+	Webhooks []Webhook
+	// Mirrors are pushed to after each commit.
+	Mirrors []Mirror
+}
+
+var config Config
+
+// LoadConfig reads the server configuration from a JSON file.
+// It has to be called before Run.
+func LoadConfig(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var c Config
+	if err := json.Unmarshal(b, &c); err != nil {
+		return errors.WithMessage(err, "parsing config "+path)
+	}
+	config = c
+	return nil
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+const diffSuffix = ".diff"
+
+// DiffLine is one line of a hunk. Origin is " " for context, "+" for added
+// and "-" for removed lines; OldLine and NewLine are -1 where not applicable.
+type DiffLine struct {
+	Origin           string
+	OldLine, NewLine int
+	Content          string
+}
+
+type DiffHunk struct {
+	Header             string
+	OldStart, OldLines int
+	NewStart, NewLines int
+	Lines              []DiffLine
+}
+
+// DiffInfo describes the changes made to Path between two commits.
+// FromID or ToID is nil if the file does not exist at that commit.
+type DiffInfo struct {
+	Path     string
+	From, To *Oid
+	FromID   *Oid
+	ToID     *Oid
+	Hunks    []DiffHunk
+}
+
+// serveDiff renders the difference of a file between the commits given by
+// the "from" and "to" query parameters. "to" defaults to the commit the
+// request is served from, "from" to the version before the last change.
+func serveDiff(ctx *RequestContext, r *http.Request, path string, jsonInfo bool) {
+	var err error
+	query := r.URL.Query()
+
+	to := ctx.rootCommit
+	if rev := query.Get("to"); rev != "" {
+		to, err = LookupRevision(rev)
+		if err == ErrorNotFound || isNotFound(err) {
+			http.NotFound(ctx.w, r)
+			return
+		}
+		Check(err, "resolving revision", http.StatusBadRequest)
+		defer to.Free()
+	}
+	newObject, err := lookupAt(to, path)
+	Check(err, "getting path", 0)
+
+	var from *git.Commit
+	if rev := query.Get("from"); rev != "" {
+		from, err = LookupRevision(rev)
+		if err == ErrorNotFound || isNotFound(err) {
+			http.NotFound(ctx.w, r)
+			return
+		}
+		Check(err, "resolving revision", http.StatusBadRequest)
+		defer from.Free()
+	} else if newObject != nil {
+		commitInfos, err := getCommitInfoPage(to, newObject, path, nil, 2)
+		Check(err, "getting history", 0)
+		if len(commitInfos) > 1 {
+			from, err = repo.LookupCommit((*git.Oid)(commitInfos[1].ID))
+			Check(err, "getting commit", 0)
+			defer from.Free()
+		}
+	}
+	var oldObject *git.Object
+	if from != nil {
+		oldObject, err = lookupAt(from, path)
+		Check(err, "getting path", 0)
+	}
+
+	if oldObject == nil && newObject == nil {
+		http.NotFound(ctx.w, r)
+		return
+	}
+	for _, object := range []*git.Object{oldObject, newObject} {
+		if object != nil && object.Type() != git.ObjectBlob {
+			http.Error(ctx.w, "Only files can be diffed.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	info := DiffInfo{Path: path, Hunks: []DiffHunk{}}
+	if from != nil {
+		info.From = (*Oid)(from.Id())
+	}
+	info.To = (*Oid)(to.Id())
+	var oldBlob, newBlob *git.Blob
+	if oldObject != nil {
+		info.FromID = (*Oid)(oldObject.Id())
+		oldBlob, err = oldObject.AsBlob()
+		Check(err, "getting blob", 0)
+	}
+	if newObject != nil {
+		info.ToID = (*Oid)(newObject.Id())
+		newBlob, err = newObject.AsBlob()
+		Check(err, "getting blob", 0)
+	}
+
+	var text bytes.Buffer
+	fmt.Fprintf(&text, "--- %s\n+++ %s\n",
+		diffName("a", path, oldBlob), diffName("b", path, newBlob))
+	err = diffBlobs(oldBlob, newBlob, path, &info, &text)
+	Check(err, "computing diff", 0)
+
+	if jsonInfo {
+		b, err := json.MarshalIndent(&info, "", "  ")
+		Check(err, "rendering JSON", http.StatusInternalServerError)
+		ctx.w.Write(b)
+		return
+	}
+	ctx.w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	ctx.w.Write(text.Bytes())
+}
+
+// diffName returns the file name for the header of a unified diff.
+func diffName(prefix, path string, blob *git.Blob) string {
+	if blob == nil {
+		return "/dev/null"
+	}
+	return prefix + path
+}
+
+// diffBlobs adds the hunks between oldBlob and newBlob to info, and writes
+// them to text as a unified diff. Either blob may be nil.
+func diffBlobs(oldBlob, newBlob *git.Blob, path string, info *DiffInfo,
+	text *bytes.Buffer) error {
+
+	opts, err := git.DefaultDiffOptions()
+	if err != nil {
+		return err
+	}
+	onLine := func(line git.DiffLine) error {
+		switch line.Origin {
+		case git.DiffLineContext, git.DiffLineAddition, git.DiffLineDeletion:
+		case git.DiffLineContextEOFNL, git.DiffLineAddEOFNL, git.DiffLineDelEOFNL:
+			text.WriteString("\\ No newline at end of file\n")
+			return nil
+		default:
+			return nil
+		}
+		origin := string(rune(line.Origin))
+		text.WriteString(origin + line.Content)
+		hunk := &info.Hunks[len(info.Hunks)-1]
+		hunk.Lines = append(hunk.Lines, DiffLine{
+			Origin:  origin,
+			OldLine: line.OldLineno,
+			NewLine: line.NewLineno,
+			Content: line.Content})
+		return nil
+	}
+	onHunk := func(hunk git.DiffHunk) (git.DiffForEachLineCallback, error) {
+		text.WriteString(hunk.Header)
+		info.Hunks = append(info.Hunks, DiffHunk{
+			Header:   strings.TrimSpace(hunk.Header),
+			OldStart: hunk.OldStart, OldLines: hunk.OldLines,
+			NewStart: hunk.NewStart, NewLines: hunk.NewLines,
+			Lines: []DiffLine{}})
+		return onLine, nil
+	}
+	onFile := func(git.DiffDelta, float64) (git.DiffForEachHunkCallback, error) {
+		return onHunk, nil
+	}
+	return git.DiffBlobs(oldBlob, path[1:], newBlob, path[1:], &opts,
+		onFile, git.DiffDetailLines)
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// lastIdError is returned by writes when the Wiki-Last-Id or If-Match supplied
+// by the client does not match the stored file.
+type lastIdError string
+
+func (e lastIdError) Error() string {
+	return string(e)
+}
+
+// etag builds a strong entity tag from the ids of the objects a response is
+// generated from.
+func etag(ids ...string) string {
+	return `"` + strings.Join(ids, "-") + `"`
+}
+
+// etagMatches checks whether etag is listed in an If-None-Match or If-Match
+// header. Weak tags are compared like strong ones.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNotModified sets the ETag header of a response. If the client already
+// has this version, it answers with 304 Not Modified and returns true.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if header := r.Header.Get("If-None-Match"); header != "" && etagMatches(header, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// requestLastId returns the id a write request expects the file to have,
+// in the format of Wiki-Last-Id. Instead of Wiki-Last-Id, clients can send
+// the ETag of the file as If-Match, "If-Match: *" if it has to exist, or
+// "If-None-Match: *" if it must not exist. The tags of listings and .json
+// responses also hold the HEAD commit; only their object id is compared, so
+// they stay valid while other paths change. If-Match uses the strong
+// comparison, so weak tags never match. conditional is set if the id was
+// taken from these standard headers, which are answered with
+// 412 Precondition Failed instead of 409 Conflict.
+func requestLastId(r *http.Request) (lastId string, conditional bool) {
+	if lastId := r.Header.Get("Wiki-Last-Id"); lastId != "" {
+		return lastId, false
+	}
+	if r.Header.Get("If-None-Match") == "*" {
+		return "null", true
+	}
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	switch {
+	case ifMatch == "":
+		return "", false
+	case ifMatch == "*":
+		return "*", true
+	case strings.Contains(ifMatch, ","):
+		panic(HttpError{"If-Match may only contain one ETag.", http.StatusBadRequest})
+	case strings.HasPrefix(ifMatch, "W/"):
+		// not an object id, fails the check of the write
+		return ifMatch, true
+	case !strings.HasPrefix(ifMatch, `"`) || !strings.HasSuffix(ifMatch, `"`) ||
+		len(ifMatch) < 2:
+		panic(HttpError{"Invalid If-Match: " + ifMatch, http.StatusBadRequest})
+	}
+	return strings.SplitN(strings.Trim(ifMatch, `"`), "-", 2)[0], true
+}
+
+// writeResult answers a write request with the commit id or error returned
+// by the write. code 0 is sent as 500.
+func writeResult(w http.ResponseWriter, err error, code int, conditional bool) {
+	if _, ok := errors.Cause(err).(lastIdError); ok && conditional {
+		code = http.StatusPreconditionFailed
+	}
+	if code == 0 {
+		code = http.StatusInternalServerError
+	}
+	http.Error(w, err.Error(), code)
+}
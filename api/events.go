@@ -0,0 +1,135 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	git "github.com/libgit2/git2go"
+)
+
+// eventBuffer is the number of events queued for a client of /.events.
+// Clients falling further behind are disconnected, and can reconnect.
+const eventBuffer = 64
+
+// eventKeepAlive is the interval of comments sent to idle event streams, so
+// that proxies do not close them.
+const eventKeepAlive = 30 * time.Second
+
+// subscribers holds the channels of all open event streams.
+var subscribers struct {
+	sync.Mutex
+	channels map[chan *CommitEvent]bool
+}
+
+func init() {
+	subscribers.channels = map[chan *CommitEvent]bool{}
+
+	OnCommit(func(ref string, commit *git.Commit) {
+		subscribers.Lock()
+		defer subscribers.Unlock()
+		if len(subscribers.channels) == 0 {
+			return
+		}
+		event, err := newCommitEvent(ref, commit)
+		if err != nil {
+			log.Println("events:", err)
+			return
+		}
+		for ch := range subscribers.channels {
+			select {
+			case ch <- event:
+			default:
+				// too slow
+				delete(subscribers.channels, ch)
+				close(ch)
+			}
+		}
+	})
+}
+
+func subscribe() chan *CommitEvent {
+	ch := make(chan *CommitEvent, eventBuffer)
+	subscribers.Lock()
+	subscribers.channels[ch] = true
+	subscribers.Unlock()
+	return ch
+}
+
+func unsubscribe(ch chan *CommitEvent) {
+	subscribers.Lock()
+	defer subscribers.Unlock()
+	if subscribers.channels[ch] {
+		delete(subscribers.channels, ch)
+		close(ch)
+	}
+}
+
+// filterPaths returns the paths of event starting with prefix. Protected
+// paths are left out unless showProtected is set.
+func filterPaths(event *CommitEvent, prefix string, showProtected bool) []string {
+	paths := []string{}
+	for _, path := range event.Paths {
+		if strings.HasPrefix(path, prefix) && (showProtected || !isProtected(path)) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// eventsHandler streams a Server-Sent Event for each new commit. With the
+// "path" parameter, only commits changing files below that prefix are sent.
+func eventsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported.", http.StatusInternalServerError)
+		return
+	}
+	prefix := r.URL.Query().Get("path")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	showProtected := isAdmin(r)
+
+	events := subscribe()
+	defer unsubscribe(events)
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			paths := filterPaths(event, prefix, showProtected)
+			if len(paths) == 0 {
+				continue
+			}
+			filtered := *event
+			filtered.Paths = paths
+			b, err := json.Marshal(&filtered)
+			Check(err, "rendering JSON", http.StatusInternalServerError)
+			fmt.Fprintf(w, "id: %s\nevent: commit\ndata: %s\n\n", event.ID, b)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -1,6 +1,13 @@
 package api
 
-import git "github.com/libgit2/git2go"
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	git "github.com/libgit2/git2go"
+)
 
 // GetRepoPath looks up an object a tree.
 // You will need to call object.Free() after usage.
@@ -17,6 +24,122 @@ func GetRepoPath(tree *git.Tree, path string) (*git.Object, error) {
 	return object, err
 }
 
+// lookupOld looks up path in tree like GetRepoPath, but returns a nil object
+// instead of an error if the path does not exist.
+func lookupOld(tree *git.Tree, path string) (*git.Object, error) {
+	object, err := GetRepoPath(tree, path)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return object, err
+}
+
+// lookupAt looks up path in the tree of commit, returning nil if it does not
+// exist there.
+func lookupAt(commit *git.Commit, path string) (*git.Object, error) {
+	tree, err := GetCommitTree(commit)
+	if err != nil {
+		return nil, err
+	}
+	if path == "/" || path == "" {
+		// the tree itself is returned
+		return &tree.Object, nil
+	}
+	defer tree.Free()
+	return lookupOld(tree, path)
+}
+
+// isNotFound checks whether err is a libgit2 "not found" error.
+func isNotFound(err error) bool {
+	gitErr, ok := err.(*git.GitError)
+	return ok && gitErr.Code == git.ErrNotFound
+}
+
+// removeDirFromIndex removes all entries below the directory path.
+func removeDirFromIndex(index *git.Index, path string) error {
+	prefix := strings.TrimSuffix(path[1:], "/") + "/"
+	var remove []string
+	for i := uint(0); i < index.EntryCount(); i++ {
+		entry, err := index.EntryByIndex(i)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(entry.Path, prefix) {
+			remove = append(remove, entry.Path)
+		}
+	}
+	for _, p := range remove {
+		if err := index.RemoveByPath(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveInIndex moves the file or all entries of the directory at path to
+// destination. Both paths must not end with a slash.
+func moveInIndex(index *git.Index, path, destination string) error {
+	from, to := path[1:], destination[1:]
+	var moved []*git.IndexEntry
+	for i := uint(0); i < index.EntryCount(); i++ {
+		entry, err := index.EntryByIndex(i)
+		if err != nil {
+			return err
+		}
+		if entry.Path == from || strings.HasPrefix(entry.Path, from+"/") {
+			moved = append(moved, entry)
+		}
+	}
+	for _, entry := range moved {
+		if err := index.RemoveByPath(entry.Path); err != nil {
+			return err
+		}
+		entry.Path = to + strings.TrimPrefix(entry.Path, from)
+		if err := index.Add(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findRename checks whether the file at path in newer was renamed from another
+// path in older, and returns that path. If not, an empty path is returned.
+func findRename(older, newer *git.Tree, path string) (string, error) {
+	opts, err := git.DefaultDiffOptions()
+	if err != nil {
+		return "", err
+	}
+	diff, err := repo.DiffTreeToTree(older, newer, &opts)
+	if err != nil {
+		return "", err
+	}
+	defer diff.Free()
+
+	findOpts, err := git.DefaultDiffFindOptions()
+	if err != nil {
+		return "", err
+	}
+	findOpts.Flags = git.DiffFindRenames
+	if err := diff.FindSimilar(&findOpts); err != nil {
+		return "", err
+	}
+
+	num, err := diff.NumDeltas()
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < num; i++ {
+		delta, err := diff.GetDelta(i)
+		if err != nil {
+			return "", err
+		}
+		if delta.Status == git.DeltaRenamed && delta.NewFile.Path == path[1:] {
+			return "/" + delta.OldFile.Path, nil
+		}
+	}
+	return "", nil
+}
+
 // ListDirCurrent lists entries in a tree object and returns an array.
 func ListDirCurrent(tree *git.Tree) []GitEntry {
 	num := tree.EntryCount()
@@ -44,6 +167,131 @@ func GetRootTree() (*git.Tree, error) {
 	return GetTreeFromRef(head)
 }
 
+// branchPrefix is the prefix of all branch references.
+const branchPrefix = "refs/heads/"
+
+var errNoBranch = errors.New("Branch does not exist.")
+
+// branchRef returns the name of the reference of branch. The empty branch is
+// the one HEAD refers to. Full reference names like refs/proposals/1 are
+// taken as they are.
+func branchRef(branch string) (string, error) {
+	if branch != "" {
+		name := branchPrefix + branch
+		if strings.HasPrefix(branch, "refs/") {
+			name = branch
+		}
+		if !git.ReferenceIsValidName(name) {
+			return "", errors.New("Invalid branch name: " + branch)
+		}
+		return name, nil
+	}
+	head, err := repo.References.Lookup("HEAD")
+	if err != nil {
+		return "", err
+	}
+	if head.Type() == git.ReferenceSymbolic {
+		return head.SymbolicTarget(), nil
+	}
+	return head.Name(), nil
+}
+
+// readBranch returns the last commit of branch as parent list for a new
+// commit, along with its tree. If HEAD is unborn, both are nil. Other branches
+// have to exist.
+// You will need to free the tree and the commits, see freeCommits, after usage.
+func readBranch(branch string) ([]*git.Commit, *git.Tree, error) {
+	name, err := branchRef(branch)
+	if err != nil {
+		return nil, nil, err
+	}
+	ref, err := repo.References.Lookup(name)
+	if isNotFound(err) && branch == "" {
+		// unborn HEAD: nothing committed yet
+		return nil, nil, nil
+	} else if isNotFound(err) {
+		return nil, nil, errNoBranch
+	} else if err != nil {
+		return nil, nil, err
+	}
+	defer ref.Free()
+	commit, err := GetCommitFromRef(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	tree, err := GetTreeFromRef(ref)
+	if err != nil {
+		commit.Free()
+		return nil, nil, err
+	}
+	return []*git.Commit{commit}, tree, nil
+}
+
+// freeCommits frees the commits returned by readBranch.
+func freeCommits(commits []*git.Commit) {
+	for _, commit := range commits {
+		commit.Free()
+	}
+}
+
+var errHeadMoved = errors.New("HEAD was moved")
+
+// updateBranch moves branch to newId, but only if it still points to the
+// first of parents, or does not exist if there are no parents.
+// Otherwise, errHeadMoved is returned.
+func updateBranch(branch string, newId *git.Oid, parents []*git.Commit, msg string) error {
+	name, err := branchRef(branch)
+	if err != nil {
+		return err
+	}
+
+	current, err := repo.References.Lookup(name)
+	if isNotFound(err) {
+		// unborn branch
+		if len(parents) != 0 {
+			return errHeadMoved
+		}
+		_, err = repo.References.Create(name, newId, false, msg)
+		if gitErr, ok := err.(*git.GitError); ok && gitErr.Code == git.ErrExists {
+			return errHeadMoved
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if len(parents) == 0 || !current.Target().Equal(parents[0].Id()) {
+		return errHeadMoved
+	}
+	// SetTarget fails if the reference was modified since the lookup.
+	_, err = current.SetTarget(newId, msg)
+	if gitErr, ok := err.(*git.GitError); ok && gitErr.Code == git.ErrModified {
+		return errHeadMoved
+	}
+	return err
+}
+
+// GetBranchCommit returns the last commit of branch, or of HEAD if branch is
+// empty.
+// You will need to call commit.Free() after usage.
+func GetBranchCommit(branch string) (*git.Commit, error) {
+	if branch == "" {
+		return GetRootCommit()
+	}
+	name, err := branchRef(branch)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := repo.References.Lookup(name)
+	if isNotFound(err) {
+		return nil, errNoBranch
+	}
+	if err != nil {
+		return nil, err
+	}
+	return GetCommitFromRef(ref)
+}
+
 // GetRootCommit returns a commit object for HEAD.
 // You will need to call commit.Free() after usage.
 func GetRootCommit() (*git.Commit, error) {
@@ -54,6 +302,37 @@ func GetRootCommit() (*git.Commit, error) {
 	return GetCommitFromRef(head)
 }
 
+// GetCommitTree returns the root tree of a commit.
+// You will need to call tree.Free() after usage.
+func GetCommitTree(commit *git.Commit) (*git.Tree, error) {
+	treeOb, err := commit.Peel(git.ObjectTree)
+	if err != nil {
+		return nil, err
+	}
+	return treeOb.AsTree()
+}
+
+var revisionRegex = regexp.MustCompile(`^(?:[0-9]+-)?([0-9a-fA-F]{4,40})$`)
+
+// LookupRevision resolves a commit id, which may be abbreviated and prefixed
+// with the number of a history entry, like "12-954abcf2".
+// You will need to call commit.Free() after usage.
+func LookupRevision(rev string) (*git.Commit, error) {
+	m := revisionRegex.FindStringSubmatch(rev)
+	if m == nil {
+		return nil, ErrorNotFound
+	}
+	object, err := repo.RevparseSingle(m[1])
+	if err != nil {
+		return nil, err
+	}
+	if object.Type() != git.ObjectCommit {
+		object.Free()
+		return nil, ErrorNotFound
+	}
+	return object.AsCommit()
+}
+
 // GetTreeFromRef returns the tree associated with a reference
 func GetTreeFromRef(ref *git.Reference) (*git.Tree, error) {
 	treeOb, err := ref.Peel(git.ObjectTree)
@@ -0,0 +1,346 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	git "github.com/libgit2/git2go"
+)
+
+// gitPrefix is where the repository is served with the git smart-HTTP
+// protocol, so that it can be cloned from http://wiki/.git/.
+const gitPrefix = "/.git"
+
+// isGitRequest checks whether a request goes to the git endpoint. Git
+// clients read and write the whole repository, bypassing the checks for
+// protected paths, so gitHandler checks them for users who are not admins.
+func isGitRequest(r *http.Request) bool {
+	return r.URL.Path == gitPrefix || strings.HasPrefix(r.URL.Path, gitPrefix+"/")
+}
+
+// isGitPush checks whether a git request is part of a push.
+func isGitPush(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, "/git-receive-pack") ||
+		r.URL.Query().Get("service") == "git-receive-pack"
+}
+
+// pushHook is the pre-receive hook run for pushes of users who are not
+// admins. Like the API, it only lets them move branches forward, without
+// changing protected paths.
+const pushHook = `#!/bin/sh
+zero=0000000000000000000000000000000000000000
+protected='(^"?|/)\.wiki([./"]|$)'
+status=0
+while read old new ref; do
+	case "$ref" in
+	refs/heads/*/*) branch= ;;
+	refs/heads/?*) branch=1 ;;
+	*) branch= ;;
+	esac
+	if [ -z "$branch" ]; then
+		echo "$ref: only admins may push to this ref." >&2; status=1; continue
+	fi
+	if [ "$new" = "$zero" ]; then
+		echo "$ref: only admins may delete branches." >&2; status=1; continue
+	fi
+	changed=
+	if [ "$old" != "$zero" ]; then
+		if ! git merge-base --is-ancestor "$old" "$new"; then
+			echo "$ref: only admins may rewrite history." >&2; status=1; continue
+		fi
+		changed=$(git -c core.quotepath=off diff-tree -r --name-only "$old" "$new") ||
+			{ status=1; continue; }
+	fi
+	commits=$(git rev-list "$new" --not --all) || { status=1; continue; }
+	changed="$changed
+$(printf '%s\n' $commits | git -c core.quotepath=off diff-tree --stdin -r --name-only --root -m)" ||
+		{ status=1; continue; }
+	if printf '%s\n' "$changed" | grep -Eq "$protected"; then
+		echo "$ref: only admins may change protected paths." >&2; status=1
+	fi
+done
+exit $status
+`
+
+var pushHooks struct {
+	sync.Once
+	dir string
+	err error
+}
+
+// pushHooksDir returns the folder holding pushHook, writing it first if
+// needed. The hook is renamed into place, so that it can be replaced while
+// another push runs it.
+// It fails if gitBinary is too old to run hooks from there, so that pushes
+// are not let through unchecked.
+func pushHooksDir(gitBinary string) (string, error) {
+	pushHooks.Do(func() {
+		if pushHooks.err = checkGitVersion(gitBinary, 2, 9); pushHooks.err != nil {
+			return
+		}
+		dir := filepath.Join(repo.Path(), "wiki-hooks")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			pushHooks.err = err
+			return
+		}
+		tmp := filepath.Join(dir, ".pre-receive.tmp")
+		if err := ioutil.WriteFile(tmp, []byte(pushHook), 0755); err != nil {
+			pushHooks.err = err
+			return
+		}
+		if err := os.Chmod(tmp, 0755); err != nil {
+			pushHooks.err = err
+			return
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, "pre-receive")); err != nil {
+			pushHooks.err = err
+			return
+		}
+		pushHooks.dir = dir
+	})
+	return pushHooks.dir, pushHooks.err
+}
+
+// checkGitVersion fails unless gitBinary is at least version major.minor.
+func checkGitVersion(gitBinary string, major, minor int) error {
+	out, err := exec.Command(gitBinary, "version").Output()
+	if err != nil {
+		return err
+	}
+	var foundMajor, foundMinor int
+	if _, err := fmt.Sscanf(string(out), "git version %d.%d", &foundMajor, &foundMinor); err != nil {
+		return errors.Wrap(err, "reading git version")
+	}
+	if foundMajor < major || foundMajor == major && foundMinor < minor {
+		return errors.Errorf("git %d.%d or newer is needed, found %d.%d",
+			major, minor, foundMajor, foundMinor)
+	}
+	return nil
+}
+
+// checkGitRead panics unless the user of r may fetch from the repository.
+// Fetches are reads, but they include all files and their history, AuthFile
+// too. So users who are not admins may only fetch if no version of it ever
+// held a plain Token, which would still be valid after switching to
+// TokenSHA256.
+func checkGitRead(w http.ResponseWriter, r *http.Request) {
+	if isAdmin(r) {
+		return
+	}
+	exposed, err := plainTokensCommitted()
+	Check(err, "checking the history of "+AuthFile, 0)
+	if !exposed {
+		return
+	}
+	msg := "Only admins may fetch, plain tokens were committed to " + AuthFile + "."
+	if RequestUser(r) == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="wiki"`)
+		panic(HttpError{msg, http.StatusUnauthorized})
+	}
+	panic(HttpError{msg, http.StatusForbidden})
+}
+
+// authHistory caches what plainTokensCommitted found out.
+var authHistory struct {
+	sync.Mutex
+	// found is set once a plain token was found. It stays in the history.
+	found bool
+	// checked lists the ref targets whose history holds no plain tokens.
+	checked []git.Oid
+	// plain tells for each version of AuthFile looked at whether it holds
+	// plain tokens.
+	plain map[git.Oid]bool
+}
+
+// plainTokensCommitted checks whether a version of AuthFile reachable from
+// any ref has a user with a plain Token. Only commits not checked before are
+// looked at.
+func plainTokensCommitted() (bool, error) {
+	authHistory.Lock()
+	defer authHistory.Unlock()
+	if authHistory.found {
+		return true, nil
+	}
+	if authHistory.plain == nil {
+		authHistory.plain = map[git.Oid]bool{}
+	}
+
+	walk, err := repo.Walk()
+	if err != nil {
+		return false, err
+	}
+	defer walk.Free()
+	iter, err := repo.NewReferenceIterator()
+	if err != nil {
+		return false, err
+	}
+	defer iter.Free()
+	var tips []git.Oid
+	for {
+		ref, err := iter.Next()
+		if git.IsErrorCode(err, git.ErrIterOver) {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		if ref.Type() != git.ReferenceOid {
+			ref.Free()
+			continue
+		}
+		commit, err := ref.Peel(git.ObjectCommit)
+		ref.Free()
+		if git.IsErrorCode(err, git.ErrInvalidSpec) {
+			// not a commit, like the metadata of proposals
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		tips = append(tips, *commit.Id())
+		err = walk.Push(commit.Id())
+		commit.Free()
+		if err != nil {
+			return false, err
+		}
+	}
+	for i := range authHistory.checked {
+		// fails if the commit is gone after a forced push
+		walk.Hide(&authHistory.checked[i])
+	}
+
+	var id git.Oid
+	for {
+		err := walk.Next(&id)
+		if git.IsErrorCode(err, git.ErrIterOver) {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		versionId, err := authVersionAt(&id)
+		if err != nil {
+			return false, err
+		}
+		if versionId == nil {
+			continue
+		}
+		plain, known := authHistory.plain[*versionId]
+		if !known {
+			if plain, err = hasPlainTokens(versionId); err != nil {
+				return false, err
+			}
+			authHistory.plain[*versionId] = plain
+		}
+		if plain {
+			authHistory.found = true
+			return true, nil
+		}
+	}
+	authHistory.checked = tips
+	return false, nil
+}
+
+// authVersionAt returns the blob id of AuthFile at the commit id, nil if it
+// has none.
+func authVersionAt(id *git.Oid) (*git.Oid, error) {
+	commit, err := repo.LookupCommit(id)
+	if err != nil {
+		return nil, err
+	}
+	defer commit.Free()
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+	entry, err := tree.EntryByPath(AuthFile[1:])
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil || entry.Type != git.ObjectBlob {
+		return nil, err
+	}
+	return entry.Id, nil
+}
+
+// hasPlainTokens checks whether the version id of AuthFile has a user with a
+// plain Token. Versions which cannot be parsed might hold tokens all the
+// same, so they count as having them.
+func hasPlainTokens(id *git.Oid) (bool, error) {
+	blob, err := repo.LookupBlob(id)
+	if err != nil {
+		return false, err
+	}
+	defer blob.Free()
+	var auth AuthConfig
+	if err := json.Unmarshal(blob.Contents(), &auth); err != nil {
+		return true, nil
+	}
+	for _, user := range auth.Users {
+		if user.Token != "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// gitHandler passes requests to git http-backend. Pushes of users who are
+// not admins are checked by pushHook, which replaces the hooks of the
+// repository for them. After a push, the commit hooks are run for the new
+// commits right away, instead of waiting for watchRefs to notice them.
+func gitHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	gitBinary, err := exec.LookPath("git")
+	Check(err, "finding git", http.StatusServiceUnavailable)
+
+	root, err := filepath.Abs(repoPath)
+	Check(err, "finding repository", 0)
+
+	env := []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"}
+	if !isGitPush(r) {
+		checkGitRead(w, r)
+	} else if !isAdmin(r) {
+		hooks, err := pushHooksDir(gitBinary)
+		Check(err, "checking pushes", http.StatusServiceUnavailable)
+		env = append(env, "GIT_CONFIG_PARAMETERS='core.hookspath="+
+			strings.Replace(hooks, "'", `'\''`, -1)+"'")
+	}
+	// http-backend only accepts pushes from authenticated users
+	if user := RequestUser(r); user != nil {
+		committer := signature(AuthorInfo{user.Name, user.Email}, time.Time{})
+		env = append(env, "REMOTE_USER="+committer.Name,
+			"GIT_COMMITTER_NAME="+committer.Name,
+			"GIT_COMMITTER_EMAIL="+committer.Email)
+	} else {
+		env = append(env, "REMOTE_USER=anonymous")
+	}
+
+	handler := &cgi.Handler{
+		Path: gitBinary,
+		Args: []string{"http-backend"},
+		Root: gitPrefix,
+		Dir:  root,
+		Env:  env}
+	handler.ServeHTTP(w, r)
+
+	if r.Method == http.MethodPost && isGitPush(r) {
+		if err := checkRefs(true); err != nil {
+			log.Println("after push:", err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cbroglie/mustache"
+	git "github.com/libgit2/git2go"
+	"github.com/pkg/errors"
+)
+
+const historySuffix = ".history"
+
+var errNotInHistory = errors.New("The commit is not in the history.")
+
+// splitHistoryPath checks whether path points into the history of a file or
+// folder. For listings like /file.md.history/ or /folder.history/, it returns
+// the path of that file or folder and an empty rev.
+// For /file.md.history/12-954abcf2 or /folder.history/12-954abcf2/sub/, rev is
+// the requested revision and rest the path below the folder.
+func splitHistoryPath(path string) (of, rev, rest string, ok bool) {
+	elements := strings.Split(path[1:], "/")
+	for i, el := range elements {
+		if !strings.HasSuffix(el, historySuffix) {
+			continue
+		}
+		of = "/" + strings.Join(append(elements[:i:i],
+			strings.TrimSuffix(el, historySuffix)), "/")
+
+		remaining := elements[i+1:]
+		if len(remaining) == 0 || remaining[0] == "" {
+			return of, "", "", true
+		}
+		rev = remaining[0]
+		if len(remaining) > 1 {
+			rest = "/" + strings.Join(remaining[1:], "/")
+		}
+		return of, rev, rest, true
+	}
+	return "", "", "", false
+}
+
+// requestHistoryPage reads the paging parameters of a history: the number of
+// entries to return, 0 for all, and the commit of the entry to start after.
+func requestHistoryPage(r *http.Request) (after *git.Oid, limit int) {
+	query := r.URL.Query()
+	if s := query.Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		Check(err, "parsing limit", http.StatusBadRequest)
+		if limit < 1 {
+			panic(HttpError{"limit must be positive.", http.StatusBadRequest})
+		}
+	}
+	if rev := query.Get("after"); rev != "" {
+		commit, err, code := resolveRevision(rev)
+		if err != nil {
+			panic(HttpError{err.Error(), code})
+		}
+		after = commit.Id()
+		commit.Free()
+	}
+	return after, limit
+}
+
+// historyErrorCode returns the status code for errors getting a history.
+func historyErrorCode(err error) int {
+	if err == errNotInHistory {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// historyName returns the name of a history entry: the commit id, prefixed
+// with the number of the change so that listings can be sorted.
+func historyName(n int, id *Oid) string {
+	return fmt.Sprintf("%d-%s", n, id.String())
+}
+
+// serveHistory renders the changes made to path as an index-of listing.
+func serveHistory(ctx *RequestContext, r *http.Request, path string, jsonInfo bool) {
+	entry, err := GetRepoPath(ctx.rootTree, path)
+	if isNotFound(err) {
+		http.NotFound(ctx.w, r)
+		return
+	}
+	Check(err, "getting path", 0)
+
+	isDir := entry.Type() == git.ObjectTree
+	if isDir && !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	if !jsonInfo && !strings.HasSuffix(ctx.urlPath, "/") {
+		http.Redirect(ctx.w, r, ctx.urlPath+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	tag := etag(entry.Id().String(), ctx.rootCommit.Id().String(), "history")
+	if jsonInfo {
+		tag = etag(entry.Id().String(), ctx.rootCommit.Id().String(), "history", "json")
+	}
+	if checkNotModified(ctx.w, r, tag) {
+		return
+	}
+
+	// the names count the entries from the oldest, so the whole history is
+	// needed for a page of it
+	commitInfos, err := getCommitInfos(ctx.rootCommit, entry, path)
+	Check(err, "getting history", http.StatusInternalServerError)
+	first, end := 0, len(commitInfos)
+	if jsonInfo {
+		after, limit := requestHistoryPage(r)
+		if after != nil {
+			first = -1
+			for i, info := range commitInfos {
+				if git.Oid(*info.ID) == *after {
+					first = i + 1
+				}
+			}
+			if first < 0 {
+				panic(HttpError{errNotInHistory.Error(), http.StatusBadRequest})
+			}
+		}
+		if limit > 0 && first+limit < end {
+			end = first + limit
+		}
+	}
+	listing := HistoryListing{
+		Path:    path,
+		ID:      (*Oid)(entry.Id()),
+		Entries: make([]HistoryEntry, 0, end-first)}
+	for i := first; i < end; i++ {
+		listing.Entries = append(listing.Entries, HistoryEntry{
+			Name:       historyName(len(commitInfos)-i, commitInfos[i].ID),
+			IsDir:      isDir,
+			CommitInfo: commitInfos[i]})
+	}
+
+	if jsonInfo {
+		b, err := json.MarshalIndent(&listing, "", "  ")
+		Check(err, "rendering JSON", http.StatusInternalServerError)
+		ctx.w.Write(b)
+		return
+	}
+	html, err := mustache.Render(TemplateHistoryOf, &listing)
+	Check(err, "rendering template", 0)
+	ctx.w.Write([]byte(html))
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	git "github.com/libgit2/git2go"
+)
+
+// CommitHook is called after a commit has been added to the branch ref,
+// e.g. "refs/heads/master", through the API or from outside, see watchRefs.
+// Hooks run one commit at a time, under hookLock, so they see commits in
+// order. They should return quickly, as later commits wait for them.
+type CommitHook func(ref string, commit *git.Commit)
+
+var commitHooks []CommitHook
+
+// hookLock serializes the calls of the commit hooks. It is taken while
+// writeLock is still held, so that hooks run in the order of the commits,
+// and released after the hooks ran. Hooks must not take writeLock.
+var hookLock sync.Mutex
+
+// OnCommit registers a hook to be called after each commit.
+// It must not be called while the server is running.
+func OnCommit(hook CommitHook) {
+	commitHooks = append(commitHooks, hook)
+}
+
+// runCommitHooks calls all hooks for the commit id made on branch. The
+// commit has already been made, so failing hooks are only logged.
+// writeLock has to be held.
+func runCommitHooks(branch string, id *git.Oid) {
+	ref, err := branchRef(branch)
+	if err != nil {
+		log.Println("commit hooks:", err)
+		return
+	}
+	if strings.HasPrefix(ref, branchPrefix) {
+		knownRefs[ref] = id
+	}
+	hookLock.Lock()
+	defer hookLock.Unlock()
+	callCommitHooks(ref, id)
+}
+
+// callCommitHooks calls all hooks for the commit id on the reference ref,
+// logging failures. Unlike runCommitHooks, it does not need writeLock.
+// hookLock has to be held.
+func callCommitHooks(ref string, id *git.Oid) {
+	if len(commitHooks) == 0 {
+		return
+	}
+	commit, err := repo.LookupCommit(id)
+	if err != nil {
+		log.Println("commit hooks:", err)
+		return
+	}
+	defer commit.Free()
+	for _, hook := range commitHooks {
+		runCommitHook(hook, ref, commit)
+	}
+}
+
+func runCommitHook(hook CommitHook, ref string, commit *git.Commit) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("commit hook: %+v\n", errors.Errorf("%v", err))
+		}
+	}()
+	hook(ref, commit)
+}
+
+// CommitEvent describes a new commit to webhooks and event streams.
+type CommitEvent struct {
+	// Ref is the reference the commit was added to, e.g. "refs/heads/master".
+	Ref     string
+	ID      *Oid
+	Author  AuthorInfo
+	Date    time.Time
+	Message string
+	// Paths lists the files changed compared to the first parent.
+	Paths []string
+}
+
+func newCommitEvent(ref string, commit *git.Commit) (*CommitEvent, error) {
+	paths, err := commitPaths(commit)
+	if err != nil {
+		return nil, err
+	}
+	author := commit.Author()
+	return &CommitEvent{
+		Ref:     ref,
+		ID:      (*Oid)(commit.Id()),
+		Author:  AuthorInfo{author.Name, author.Email},
+		Date:    author.When,
+		Message: commit.Message(),
+		Paths:   paths}, nil
+}
+
+// changedFiles lists the files which differ between the tree with id oldId
+// and newTree. All files of newTree are returned as added if oldId is nil.
+func changedFiles(oldId *git.Oid, newTree *git.Tree) ([]git.DiffDelta, error) {
+	var oldTree *git.Tree
+	if oldId != nil {
+		var err error
+		if oldTree, err = repo.LookupTree(oldId); err != nil {
+			return nil, err
+		}
+		defer oldTree.Free()
+	}
+	diff, err := repo.DiffTreeToTree(oldTree, newTree, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer diff.Free()
+
+	n, err := diff.NumDeltas()
+	if err != nil {
+		return nil, err
+	}
+	deltas := make([]git.DiffDelta, 0, n)
+	for i := 0; i < n; i++ {
+		delta, err := diff.GetDelta(i)
+		if err != nil {
+			return nil, err
+		}
+		deltas = append(deltas, delta)
+	}
+	return deltas, nil
+}
+
+// commitPaths lists the paths of the files changed by commit, compared to its
+// first parent.
+func commitPaths(commit *git.Commit) ([]string, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+	var parentTreeId *git.Oid
+	if parent := commit.Parent(0); parent != nil {
+		parentTreeId = parent.TreeId()
+		parent.Free()
+	}
+	deltas, err := changedFiles(parentTreeId, tree)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(deltas))
+	for _, delta := range deltas {
+		if delta.Status == git.DeltaDeleted {
+			paths = append(paths, "/"+delta.OldFile.Path)
+		} else {
+			paths = append(paths, "/"+delta.NewFile.Path)
+		}
+	}
+	return paths, nil
+}
+
+// treeIndex is an index over the files of a tree.
+type treeIndex interface {
+	add(path string, id *git.Oid) error
+	remove(path string)
+}
+
+// updateTreeIndex applies the changes between the tree with id oldId and
+// newTree to idx, so that only changed files are read again.
+func updateTreeIndex(idx treeIndex, oldId *git.Oid, newTree *git.Tree) error {
+	deltas, err := changedFiles(oldId, newTree)
+	if err != nil {
+		return err
+	}
+	for _, delta := range deltas {
+		if delta.Status != git.DeltaAdded {
+			idx.remove("/" + delta.OldFile.Path)
+		}
+		if delta.Status != git.DeltaDeleted {
+			if err := idx.add("/"+delta.NewFile.Path, delta.NewFile.Oid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
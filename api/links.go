@@ -0,0 +1,340 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+	git "github.com/libgit2/git2go"
+)
+
+const markdownSuffix = ".md"
+
+var (
+	// inlineLinkRegex matches [text](target "title"), and images if preceded
+	// by "!".
+	inlineLinkRegex = regexp.MustCompile(`(!?)\[[^\]]*\]\(\s*<?([^)\s>]+)>?(?:\s+"[^"]*")?\s*\)`)
+	// refLinkRegex matches reference definitions like [ref]: target "title".
+	refLinkRegex = regexp.MustCompile(`^ {0,3}\[[^\]]+\]:\s*<?([^\s>]+)>?`)
+)
+
+// pageLink is a link from a Markdown page to another path of the wiki.
+type pageLink struct {
+	// Link is the target as written in the page, Target the absolute,
+	// cleaned path it points to.
+	Link, Target string
+	Line         int
+}
+
+// parseLinks returns the links to other wiki paths in the Markdown page at
+// source. Links to other sites, images and links inside fenced code blocks
+// are skipped.
+func parseLinks(source string, content []byte) []pageLink {
+	links := []pageLink{}
+	inFence := false
+	for i, line := range strings.Split(string(content), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			continue
+		}
+
+		var targets []string
+		for _, match := range inlineLinkRegex.FindAllStringSubmatch(line, -1) {
+			if match[1] == "" {
+				targets = append(targets, match[2])
+			}
+		}
+		if match := refLinkRegex.FindStringSubmatch(line); match != nil {
+			targets = append(targets, match[1])
+		}
+		for _, target := range targets {
+			if resolved, ok := resolveLink(source, target); ok {
+				links = append(links, pageLink{target, resolved, i + 1})
+			}
+		}
+	}
+	return links
+}
+
+// resolveLink resolves target relative to the page at source. ok is false for
+// links to other sites and links inside the page.
+func resolveLink(source, target string) (resolved string, ok bool) {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return "", false
+	}
+	p := u.Path
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join(path.Dir(source), p)
+	}
+	return path.Clean(p), true
+}
+
+// linkGraph holds the links between the Markdown pages of a tree.
+type linkGraph struct {
+	sync.Mutex
+	// tree is the id of the indexed tree, nil if nothing was indexed yet.
+	tree     *git.Oid
+	outgoing map[string][]pageLink
+	// incoming maps each target to the pages linking to it.
+	incoming map[string]map[string]bool
+}
+
+var linkIdx = newLinkGraph()
+
+func init() {
+	OnCommit(func(ref string, commit *git.Commit) {
+		linkIdx.Lock()
+		defer linkIdx.Unlock()
+		if linkIdx.tree == nil {
+			// not built yet, will be built when it is first needed
+			return
+		}
+		// the commit might have been made on another branch
+		if _, err := linkIdx.sync(); err != nil {
+			log.Println("updating link graph:", err)
+		}
+	})
+}
+
+func newLinkGraph() *linkGraph {
+	return &linkGraph{
+		outgoing: map[string][]pageLink{},
+		incoming: map[string]map[string]bool{}}
+}
+
+// sync brings the graph up to date with HEAD, and returns the id of the
+// indexed tree. The caller must hold the lock.
+func (g *linkGraph) sync() (*git.Oid, error) {
+	commits, tree, err := readBranch("")
+	freeCommits(commits)
+	if err != nil || tree == nil {
+		return nil, err
+	}
+	defer tree.Free()
+	if err := g.update(tree); err != nil {
+		return nil, err
+	}
+	return g.tree, nil
+}
+
+// update re-reads the pages which differ between the indexed tree and tree.
+// The caller must hold the lock.
+func (g *linkGraph) update(tree *git.Tree) error {
+	if g.tree != nil && g.tree.Equal(tree.Id()) {
+		return nil
+	}
+	if err := updateTreeIndex(g, g.tree, tree); err != nil {
+		return err
+	}
+	g.tree = tree.Id()
+	return nil
+}
+
+func (g *linkGraph) add(path string, id *git.Oid) error {
+	if !strings.HasSuffix(path, markdownSuffix) || isProtected(path) {
+		return nil
+	}
+	blob, err := repo.LookupBlob(id)
+	if err != nil {
+		return err
+	}
+	defer blob.Free()
+
+	pageLinks := parseLinks(path, blob.Contents())
+	g.outgoing[path] = pageLinks
+	for _, link := range pageLinks {
+		sources := g.incoming[link.Target]
+		if sources == nil {
+			sources = map[string]bool{}
+			g.incoming[link.Target] = sources
+		}
+		sources[path] = true
+	}
+	return nil
+}
+
+func (g *linkGraph) remove(path string) {
+	for _, link := range g.outgoing[path] {
+		delete(g.incoming[link.Target], path)
+		if len(g.incoming[link.Target]) == 0 {
+			delete(g.incoming, link.Target)
+		}
+	}
+	delete(g.outgoing, path)
+}
+
+// backlinks returns the pages linking to path, sorted.
+func (g *linkGraph) backlinks(path string) []string {
+	res := []string{}
+	for source := range g.incoming[path] {
+		if source != path {
+			res = append(res, source)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// outgoingLinks returns the distinct targets of the links in the page at path,
+// sorted.
+func (g *linkGraph) outgoingLinks(path string) []string {
+	seen := map[string]bool{}
+	res := []string{}
+	for _, link := range g.outgoing[path] {
+		if !seen[link.Target] {
+			seen[link.Target] = true
+			res = append(res, link.Target)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// orphans returns the pages no other page links to, sorted.
+func (g *linkGraph) orphans() []string {
+	res := []string{}
+	for page := range g.outgoing {
+		if len(g.backlinks(page)) == 0 {
+			res = append(res, page)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// addLinks fills in the links of info if it describes a file in HEAD.
+func addLinks(ctx *RequestContext, info *FileInfo) {
+	linkIdx.Lock()
+	defer linkIdx.Unlock()
+	tree, err := linkIdx.sync()
+	Check(err, "updating link graph", 0)
+	if tree == nil || !tree.Equal(ctx.rootTree.Id()) {
+		// historic version
+		return
+	}
+	info.Backlinks = linkIdx.backlinks(info.Path)
+	info.OutgoingLinks = linkIdx.outgoingLinks(info.Path)
+}
+
+type OrphansReport struct {
+	Orphans []string
+}
+
+func orphansHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	linkIdx.Lock()
+	_, err := linkIdx.sync()
+	report := OrphansReport{Orphans: linkIdx.orphans()}
+	linkIdx.Unlock()
+	Check(err, "updating link graph", 0)
+
+	b, err := json.MarshalIndent(&report, "", "  ")
+	Check(err, "rendering JSON", http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// BrokenLink is a link to a path which does not exist.
+type BrokenLink struct {
+	Source string
+	Line   int
+	Link   string
+	Target string
+}
+
+type BrokenLinksReport struct {
+	Broken []BrokenLink
+}
+
+// BrokenLinks checks the links of all Markdown pages in HEAD, and returns
+// those pointing to paths which do not exist, sorted by page and line.
+// Links to special endpoints are not checked, and links to views of a file or
+// folder like its history are checked against the file or folder.
+func BrokenLinks() ([]BrokenLink, error) {
+	linkIdx.Lock()
+	defer linkIdx.Unlock()
+	treeId, err := linkIdx.sync()
+	if err != nil || treeId == nil {
+		return []BrokenLink{}, err
+	}
+	tree, err := repo.LookupTree(treeId)
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+
+	pages := make([]string, 0, len(linkIdx.outgoing))
+	for page := range linkIdx.outgoing {
+		pages = append(pages, page)
+	}
+	sort.Strings(pages)
+
+	broken := []BrokenLink{}
+	for _, page := range pages {
+		for _, link := range linkIdx.outgoing[page] {
+			if isReserved(link.Target) {
+				continue
+			}
+			err := pathExists(tree, link.Target)
+			if viewed := viewedPath(link.Target); isNotFound(err) && viewed != link.Target {
+				err = pathExists(tree, viewed)
+			}
+			if isNotFound(err) {
+				broken = append(broken, BrokenLink{page, link.Line, link.Link, link.Target})
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return broken, nil
+}
+
+// pathExists returns a not found error if path does not exist in tree. The
+// object itself is not loaded.
+func pathExists(tree *git.Tree, path string) error {
+	if path == "/" || path == "" {
+		return nil
+	}
+	_, err := tree.EntryByPath(path[1:])
+	return err
+}
+
+// viewedPath returns the path of the file or folder shown by a view like
+// /page.md.history/ or /page.md.diff.json, and target itself for other paths.
+func viewedPath(target string) string {
+	if of, _, _, ok := splitHistoryPath(target); ok {
+		return of
+	}
+	viewed := strings.TrimSuffix(target, ".json")
+	for _, suffix := range []string{diffSuffix, blameSuffix} {
+		viewed = strings.TrimSuffix(viewed, suffix)
+	}
+	if viewed == "" {
+		return "/"
+	}
+	return viewed
+}
+
+func brokenLinksHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	broken, err := BrokenLinks()
+	Check(err, "checking links", 0)
+	b, err := json.MarshalIndent(&BrokenLinksReport{broken}, "", "  ")
+	Check(err, "rendering JSON", http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+	"github.com/pkg/errors"
+)
+
+// MergeConflict is returned by PutFile if the changes to a file could not be
+// merged automatically. It is sent to the client as JSON, so that the conflict
+// can be resolved there.
+type MergeConflict struct {
+	Path string
+	// BaseID is the Wiki-Last-Id the changes were based on. TheirsID is the
+	// file currently stored, and has to be sent as Wiki-Last-Id once the
+	// conflict is resolved.
+	BaseID, TheirsID *Oid
+	Base             string
+	Theirs           string
+	Ours             string
+	// Merged holds the merge result, including conflict markers.
+	Merged string
+}
+
+func (c *MergeConflict) Error() string {
+	return "Merge conflict in " + c.Path
+}
+
+// renderConflict sends a merge conflict to the client.
+func renderConflict(w http.ResponseWriter, conflict *MergeConflict) {
+	b, err := json.MarshalIndent(conflict, "", "  ")
+	Check(err, "rendering JSON", http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	w.Write(b)
+}
+
+// checkMergeBase checks that baseId, the lastId of a merging write, is a
+// version path had on branch. Other blobs must not be merged, as they would be
+// sent back with a MergeConflict. Ids which cannot be parsed are left to the
+// write to reject.
+func checkMergeBase(path, baseId, branch string) (error, int) {
+	baseOid, err := git.NewOid(baseId)
+	if err != nil {
+		return nil, http.StatusOK
+	}
+	commits, tree, err := readBranch(branch)
+	if err != nil || commits == nil {
+		// no history, the write fails
+		return nil, http.StatusOK
+	}
+	defer freeCommits(commits)
+	tree.Free()
+
+	changeIdx.Lock()
+	defer changeIdx.Unlock()
+	node, err := changeIdx.index(commits[0].Id())
+	if err != nil {
+		return err, 0
+	}
+	if changeIdx.lastChange(node, strings.Trim(path, "/"), baseOid) == nil {
+		return errors.New("lastId is not a version of " + path + "."),
+			http.StatusBadRequest
+	}
+	return nil, http.StatusOK
+}
+
+// mergeBlob does a line-based three-way merge: the changes between the blob
+// baseId and ours are applied to theirs, the blob currently stored at path.
+// It returns the id of the merged blob. If the changes conflict, the error is
+// a *MergeConflict.
+func mergeBlob(path, baseId string, theirs *git.Object, ours []byte) (*git.Oid, error, int) {
+	baseOid, err := git.NewOid(baseId)
+	if err != nil {
+		return nil, lastIdError("lastId did not match existing entry."),
+			http.StatusConflict
+	}
+	base, err := repo.LookupBlob(baseOid)
+	if err != nil {
+		return nil, lastIdError("lastId did not match existing entry, and is unknown."),
+			http.StatusConflict
+	}
+	defer base.Free()
+	theirsBlob, err := theirs.AsBlob()
+	if err != nil {
+		return nil, err, 0
+	}
+
+	input := func(contents []byte) git.MergeFileInput {
+		return git.MergeFileInput{
+			Path:     path[1:],
+			Mode:     uint(git.FilemodeBlob),
+			Contents: contents}
+	}
+	result, err := git.MergeFile(input(base.Contents()), input(ours),
+		input(theirsBlob.Contents()), &git.MergeFileOptions{
+			AncestorLabel: "base",
+			OurLabel:      "ours",
+			TheirLabel:    "theirs"})
+	if err != nil {
+		return nil, err, 0
+	}
+	defer result.Free()
+
+	if !result.Automergeable {
+		return nil, &MergeConflict{
+			Path:     path,
+			BaseID:   (*Oid)(baseOid),
+			TheirsID: (*Oid)(theirs.Id()),
+			Base:     string(base.Contents()),
+			Theirs:   string(theirsBlob.Contents()),
+			Ours:     string(ours),
+			Merged:   string(result.Contents)}, http.StatusConflict
+	}
+
+	mergedId, err := repo.CreateBlobFromBuffer(result.Contents)
+	if err != nil {
+		return nil, err, 0
+	}
+	return mergedId, nil, http.StatusOK
+}
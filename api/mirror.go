@@ -0,0 +1,224 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	git "github.com/libgit2/git2go"
+)
+
+// Mirror is a remote repository kept up to date with all refs, configured in
+// the Mirrors section of the config file.
+type Mirror struct {
+	// URL is anything git push accepts, like the path of a local bare
+	// repository or ssh://backup.example.com/wiki.git.
+	URL string
+}
+
+// MirrorStatus describes the replication to one mirror.
+type MirrorStatus struct {
+	URL         string
+	LastSuccess time.Time
+	LastAttempt time.Time
+	LastError   string `json:",omitempty"`
+	// Failures counts the failed attempts since the last success.
+	Failures int
+	// Pushed is the commit of HEAD at the last successful push.
+	Pushed *Oid
+	// Pending is set while there are changes which have not been pushed.
+	// Lag is the time in seconds since the oldest of them was made.
+	Pending bool
+	Lag     float64
+}
+
+type MirrorListing struct {
+	Mirrors []MirrorStatus
+}
+
+const (
+	// mirrorDelay is how long a mirror waits for further commits before
+	// pushing, mirrorMaxDelay the longest it waits while commits keep coming.
+	mirrorDelay    = 2 * time.Second
+	mirrorMaxDelay = time.Minute
+	// Failed pushes are retried after mirrorRetry, doubled after each further
+	// failure up to mirrorMaxRetry.
+	mirrorRetry    = 10 * time.Second
+	mirrorMaxRetry = 30 * time.Minute
+	mirrorTimeout  = 30 * time.Minute
+)
+
+type mirror struct {
+	sync.Mutex
+	status MirrorStatus
+	// pendingSince is the time of the oldest change not pushed yet, seq
+	// counts the changes.
+	pendingSince time.Time
+	seq          int
+	trigger      chan bool
+}
+
+var mirrors []*mirror
+
+func init() {
+	OnCommit(func(ref string, commit *git.Commit) {
+		for _, m := range mirrors {
+			m.notify()
+		}
+	})
+}
+
+// startMirrors starts replicating to the configured mirrors. The first push
+// catches up with changes made while the server was not running.
+func startMirrors() {
+	for _, c := range config.Mirrors {
+		m := &mirror{
+			status:  MirrorStatus{URL: c.URL},
+			trigger: make(chan bool, 1)}
+		mirrors = append(mirrors, m)
+		m.notify()
+		go m.run()
+	}
+}
+
+// notify schedules a push.
+func (m *mirror) notify() {
+	m.Lock()
+	if m.pendingSince.IsZero() {
+		m.pendingSince = time.Now()
+	}
+	m.seq++
+	m.Unlock()
+	m.retry()
+}
+
+// retry schedules a push without recording a new change.
+func (m *mirror) retry() {
+	select {
+	case m.trigger <- true:
+	default:
+		// already scheduled
+	}
+}
+
+func (m *mirror) run() {
+	wait := mirrorRetry
+	for range m.trigger {
+		// wait until commits stop coming in for a moment
+		deadline := time.After(mirrorMaxDelay)
+	debounce:
+		for {
+			select {
+			case <-m.trigger:
+			case <-time.After(mirrorDelay):
+				break debounce
+			case <-deadline:
+				break debounce
+			}
+		}
+
+		if err := m.push(); err != nil {
+			log.Printf("mirror %s: %v, retrying in %s\n", m.status.URL, err, wait)
+			time.AfterFunc(wait, m.retry)
+			if wait *= 2; wait > mirrorMaxRetry {
+				wait = mirrorMaxRetry
+			}
+		} else {
+			wait = mirrorRetry
+		}
+	}
+}
+
+// push mirrors all refs, and records the result in the status.
+func (m *mirror) push() error {
+	m.Lock()
+	seq := m.seq
+	m.status.LastAttempt = time.Now()
+	m.Unlock()
+
+	var head *Oid
+	if commit, err := GetRootCommit(); err == nil {
+		head = (*Oid)(commit.Id())
+		commit.Free()
+	}
+	err := pushMirror(m.status.URL)
+
+	m.Lock()
+	defer m.Unlock()
+	if err != nil {
+		m.status.LastError = err.Error()
+		m.status.Failures++
+		return err
+	}
+	m.status.LastSuccess = m.status.LastAttempt
+	m.status.LastError = ""
+	m.status.Failures = 0
+	m.status.Pushed = head
+	if seq == m.seq {
+		m.pendingSince = time.Time{}
+	} else {
+		// committed while pushing
+		m.pendingSince = m.status.LastAttempt
+	}
+	return nil
+}
+
+// pushMirror runs git push --mirror to url.
+func pushMirror(url string) error {
+	root, err := filepath.Abs(repoPath)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", "push", "--mirror", "--quiet", url)
+	cmd.Dir = root
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return errors.New(msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// currentStatus returns the status, with Lag computed at now.
+func (m *mirror) currentStatus(now time.Time) MirrorStatus {
+	m.Lock()
+	defer m.Unlock()
+	status := m.status
+	if !m.pendingSince.IsZero() {
+		status.Pending = true
+		status.Lag = now.Sub(m.pendingSince).Seconds()
+	}
+	return status
+}
+
+// mirrorsHandler lists the status of all mirrors. Only admins may see it, as
+// the URLs might hold credentials.
+func mirrorsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+	checkAdmin(r)
+
+	listing := MirrorListing{make([]MirrorStatus, 0, len(mirrors))}
+	now := time.Now()
+	for _, m := range mirrors {
+		listing.Mirrors = append(listing.Mirrors, m.currentStatus(now))
+	}
+	b, err := json.MarshalIndent(&listing, "", "  ")
+	Check(err, "rendering JSON", http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,553 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	git "github.com/libgit2/git2go"
+)
+
+const (
+	// proposalPrefix is the prefix of the references holding the proposed
+	// commits, proposalMetaPrefix that of the references to their metadata,
+	// which is stored as JSON blob.
+	proposalPrefix     = "refs/proposals/"
+	proposalMetaPrefix = "refs/meta/proposals/"
+)
+
+const (
+	ProposalOpen     = "open"
+	ProposalApproved = "approved"
+	ProposalRejected = "rejected"
+)
+
+// Proposal is a change suggested by a contributor, which is only applied to
+// HEAD once a maintainer approves it.
+type Proposal struct {
+	ID          int
+	Author      AuthorInfo
+	Description string
+	// Status is "open", "approved" or "rejected".
+	Status  string
+	Created time.Time
+	// Base is the commit of HEAD the proposal was made on, Head the last
+	// commit of the proposal.
+	Base, Head *Oid
+	// Merged is the commit which applied an approved proposal to HEAD.
+	Merged   *Oid `json:",omitempty"`
+	Comments []ProposalComment
+}
+
+type ProposalComment struct {
+	Author AuthorInfo
+	Date   time.Time
+	Text   string
+}
+
+type ProposalListing struct {
+	Proposals []Proposal
+}
+
+// NewProposal is the request body for creating a proposal.
+type NewProposal struct {
+	Description string
+	Operations  []Operation
+}
+
+var errNoProposal = errors.New("Proposal does not exist.")
+
+// proposalLock serializes changes to the metadata of proposals.
+var proposalLock sync.Mutex
+
+// proposalRef returns the name of the reference holding the commits of
+// proposal id. It can be used as CommitMeta.Branch.
+func proposalRef(id int) string {
+	return proposalPrefix + strconv.Itoa(id)
+}
+
+func proposalMetaRef(id int) string {
+	return proposalMetaPrefix + strconv.Itoa(id)
+}
+
+// GetProposal reads the metadata of proposal id.
+func GetProposal(id int) (*Proposal, error) {
+	ref, err := repo.References.Lookup(proposalMetaRef(id))
+	if isNotFound(err) {
+		return nil, errNoProposal
+	} else if err != nil {
+		return nil, err
+	}
+	blob, err := repo.LookupBlob(ref.Target())
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Free()
+	var p Proposal
+	if err := json.Unmarshal(blob.Contents(), &p); err != nil {
+		return nil, errors.Wrap(err, "reading proposal "+strconv.Itoa(id))
+	}
+
+	head, err := repo.References.Lookup(proposalRef(id))
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		p.Head = (*Oid)(head.Target())
+	}
+	return &p, nil
+}
+
+// saveProposal stores the metadata of p. proposalLock has to be held.
+func saveProposal(p *Proposal) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	blobId, err := repo.CreateBlobFromBuffer(b)
+	if err != nil {
+		return err
+	}
+	_, err = repo.References.Create(proposalMetaRef(p.ID), blobId, true,
+		"proposal: "+p.Status)
+	return err
+}
+
+// ListProposals returns all proposals with the given status, or all of them
+// if status is empty, sorted by id.
+func ListProposals(status string) ([]Proposal, error) {
+	iter, err := repo.NewReferenceIteratorGlob(proposalMetaPrefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Free()
+	names := iter.Names()
+
+	proposals := []Proposal{}
+	for {
+		name, err := names.Next()
+		if gitErr, ok := err.(*git.GitError); ok && gitErr.Code == git.ErrIterOver {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(name, proposalMetaPrefix))
+		if err != nil {
+			// not created by us
+			continue
+		}
+		p, err := GetProposal(id)
+		if err != nil {
+			return nil, err
+		}
+		if status == "" || p.Status == status {
+			proposals = append(proposals, *p)
+		}
+	}
+	sort.Sort(byProposalId(proposals))
+	return proposals, nil
+}
+
+type byProposalId []Proposal
+
+func (p byProposalId) Len() int           { return len(p) }
+func (p byProposalId) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byProposalId) Less(i, j int) bool { return p[i].ID < p[j].ID }
+
+// CreateProposal commits ops on top of HEAD to a new proposal, leaving HEAD
+// unchanged.
+func CreateProposal(description string, ops []Operation, meta CommitMeta) (*Proposal, error, int) {
+	if strings.TrimSpace(description) == "" {
+		return nil, errors.New("A description is required."), http.StatusBadRequest
+	}
+	if meta.Message == "" {
+		meta.Message = description
+	}
+
+	proposalLock.Lock()
+	defer proposalLock.Unlock()
+
+	proposals, err := ListProposals("")
+	if err != nil {
+		return nil, err, 0
+	}
+	id := 1
+	if len(proposals) > 0 {
+		id = proposals[len(proposals)-1].ID + 1
+	}
+	base, err := GetRootCommit()
+	if err != nil {
+		return nil, errors.New("No commit exists."), http.StatusNotFound
+	}
+	defer base.Free()
+
+	ref, err := repo.References.Create(proposalRef(id), base.Id(), false, "proposal: create")
+	if err != nil {
+		return nil, err, 0
+	}
+	meta.Branch = proposalRef(id)
+	if err, code := CommitBatch(ops, meta); code != http.StatusOK {
+		ref.Delete()
+		return nil, err, code
+	}
+
+	p := &Proposal{
+		ID:          id,
+		Author:      meta.Author,
+		Description: description,
+		Status:      ProposalOpen,
+		Created:     time.Now(),
+		Base:        (*Oid)(base.Id()),
+		Comments:    []ProposalComment{}}
+	if err := saveProposal(p); err != nil {
+		return nil, err, 0
+	}
+	return p, nil, http.StatusOK
+}
+
+// openProposal returns proposal id if it is still open.
+func openProposal(id int) (*Proposal, error, int) {
+	p, err := GetProposal(id)
+	if err == errNoProposal {
+		return nil, err, http.StatusNotFound
+	} else if err != nil {
+		return nil, err, 0
+	}
+	if p.Status != ProposalOpen {
+		return nil, errors.New("Proposal is " + p.Status + "."), http.StatusConflict
+	}
+	return p, nil, http.StatusOK
+}
+
+// UpdateProposal commits further operations to an open proposal, for example
+// to address review comments.
+// Like PutFile, the commit id is returned as error with status 200.
+func UpdateProposal(id int, ops []Operation, meta CommitMeta) (error, int) {
+	proposalLock.Lock()
+	defer proposalLock.Unlock()
+
+	if _, err, code := openProposal(id); err != nil {
+		return err, code
+	}
+	meta.Branch = proposalRef(id)
+	return CommitBatch(ops, meta)
+}
+
+// CommentProposal adds a comment to proposal id.
+func CommentProposal(id int, text string, author AuthorInfo) (*Proposal, error, int) {
+	if strings.TrimSpace(text) == "" {
+		return nil, errors.New("Empty comment."), http.StatusBadRequest
+	}
+
+	proposalLock.Lock()
+	defer proposalLock.Unlock()
+
+	p, err := GetProposal(id)
+	if err == errNoProposal {
+		return nil, err, http.StatusNotFound
+	} else if err != nil {
+		return nil, err, 0
+	}
+	p.Comments = append(p.Comments, ProposalComment{author, time.Now(), text})
+	if err := saveProposal(p); err != nil {
+		return nil, err, 0
+	}
+	return p, nil, http.StatusOK
+}
+
+// ApproveProposal merges proposal id into HEAD, fast-forwarding if HEAD has
+// not changed since. Conflicts are returned as *BranchConflict.
+// Like PutFile, the commit id is returned as error with status 200.
+func ApproveProposal(id int, meta CommitMeta) (error, int) {
+	proposalLock.Lock()
+	defer proposalLock.Unlock()
+
+	p, err, code := openProposal(id)
+	if err != nil {
+		return err, code
+	}
+	if meta.Message == "" {
+		meta.Message = fmt.Sprintf("Merge proposal #%d: %s", id,
+			strings.SplitN(p.Description, "\n", 2)[0])
+	}
+	result, code := MergeBranch(proposalRef(id), "", meta)
+	if code != http.StatusOK {
+		return result, code
+	}
+	merged, err := git.NewOid(result.Error())
+	if err != nil {
+		return err, 0
+	}
+
+	p.Status = ProposalApproved
+	p.Merged = (*Oid)(merged)
+	if err := saveProposal(p); err != nil {
+		return err, 0
+	}
+	return result, code
+}
+
+// RejectProposal closes proposal id without applying it. A non-empty comment
+// is added to the proposal.
+func RejectProposal(id int, comment string, author AuthorInfo) (error, int) {
+	proposalLock.Lock()
+	defer proposalLock.Unlock()
+
+	p, err, code := openProposal(id)
+	if err != nil {
+		return err, code
+	}
+	if strings.TrimSpace(comment) != "" {
+		p.Comments = append(p.Comments, ProposalComment{author, time.Now(), comment})
+	}
+	p.Status = ProposalRejected
+	if err := saveProposal(p); err != nil {
+		return err, 0
+	}
+	return errors.New("Proposal rejected."), http.StatusOK
+}
+
+// ProposalDiff describes the files changed by a proposal, from its base to
+// its last commit. It also returns them as unified diff.
+func ProposalDiff(p *Proposal) ([]DiffInfo, []byte, error) {
+	var trees [2]*git.Tree
+	for i, id := range []*Oid{p.Base, p.Head} {
+		commit, err := repo.LookupCommit((*git.Oid)(id))
+		if err != nil {
+			return nil, nil, err
+		}
+		trees[i], err = GetCommitTree(commit)
+		commit.Free()
+		if err != nil {
+			return nil, nil, err
+		}
+		defer trees[i].Free()
+	}
+	deltas, err := changedFiles(trees[0].Id(), trees[1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	infos := make([]DiffInfo, 0, len(deltas))
+	var text bytes.Buffer
+	for _, delta := range deltas {
+		info := DiffInfo{
+			Path:  "/" + delta.NewFile.Path,
+			From:  p.Base,
+			To:    p.Head,
+			Hunks: []DiffHunk{}}
+		var oldBlob, newBlob *git.Blob
+		if delta.Status != git.DeltaAdded {
+			info.Path = "/" + delta.OldFile.Path
+			info.FromID = (*Oid)(delta.OldFile.Oid)
+			if oldBlob, err = repo.LookupBlob(delta.OldFile.Oid); err != nil {
+				return nil, nil, err
+			}
+			defer oldBlob.Free()
+		}
+		if delta.Status != git.DeltaDeleted {
+			info.ToID = (*Oid)(delta.NewFile.Oid)
+			if newBlob, err = repo.LookupBlob(delta.NewFile.Oid); err != nil {
+				return nil, nil, err
+			}
+			defer newBlob.Free()
+		}
+
+		fmt.Fprintf(&text, "--- %s\n+++ %s\n",
+			diffName("a", info.Path, oldBlob), diffName("b", info.Path, newBlob))
+		if err := diffBlobs(oldBlob, newBlob, info.Path, &info, &text); err != nil {
+			return nil, nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, text.Bytes(), nil
+}
+
+// isProposalSubmission checks whether a write request only submits or
+// comments on a proposal, which is all users with ProposeOnly may do.
+func isProposalSubmission(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return false
+	}
+	elements := strings.Split(strings.TrimPrefix(r.URL.Path, "/.proposals"), "/")
+	switch len(elements) {
+	case 1:
+		return elements[0] == ""
+	case 2:
+		return elements[0] == ""
+	case 3:
+		return elements[0] == "" && elements[2] == "comments"
+	}
+	return false
+}
+
+// proposalParam returns the proposal id of a request, or panics with
+// 404 Not Found if it is invalid.
+func proposalParam(p httprouter.Params) int {
+	id, err := strconv.Atoi(p.ByName("id"))
+	if err != nil {
+		panic(HttpError{errNoProposal.Error(), http.StatusNotFound})
+	}
+	return id
+}
+
+func renderProposalJSON(w http.ResponseWriter, v interface{}, code int) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	Check(err, "rendering JSON", http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// readProposal reads the body of a request creating or updating a proposal,
+// and makes sure only admins touch the protected directory.
+func readProposal(r *http.Request) NewProposal {
+	var request NewProposal
+	err := json.NewDecoder(r.Body).Decode(&request)
+	Check(err, "parsing proposal", http.StatusBadRequest)
+	for _, op := range request.Operations {
+		checkProtectedWrite(r, op.Path)
+		checkProtectedWrite(r, op.Destination)
+	}
+	return request
+}
+
+func proposalsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	proposals, err := ListProposals(r.URL.Query().Get("status"))
+	Check(err, "listing proposals", 0)
+	renderProposalJSON(w, &ProposalListing{proposals}, http.StatusOK)
+}
+
+func createProposalHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	request := readProposal(r)
+	meta := requestCommitMeta(r)
+	meta.Branch = ""
+
+	proposal, err, code := CreateProposal(request.Description, request.Operations, meta)
+	if err != nil {
+		writeResult(w, err, code, false)
+		return
+	}
+	renderProposalJSON(w, proposal, http.StatusCreated)
+}
+
+func proposalHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	proposal, err := GetProposal(proposalParam(p))
+	if err == errNoProposal {
+		http.NotFound(w, r)
+		return
+	}
+	Check(err, "reading proposal", 0)
+	renderProposalJSON(w, proposal, http.StatusOK)
+}
+
+// updateProposalHandler takes further operations like POST /.commit, the
+// description is ignored. Users
+// with ProposeOnly may only update their own proposals.
+func updateProposalHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	id := proposalParam(p)
+	request := readProposal(r)
+	meta := requestCommitMeta(r)
+
+	if user := RequestUser(r); user != nil && user.ProposeOnly {
+		proposal, err := GetProposal(id)
+		if err == errNoProposal {
+			http.NotFound(w, r)
+			return
+		}
+		Check(err, "reading proposal", 0)
+		if proposal.Author != (AuthorInfo{user.Name, user.Email}) {
+			http.Error(w, "Only the author may change this proposal.", http.StatusForbidden)
+			return
+		}
+	}
+
+	err, code := UpdateProposal(id, request.Operations, meta)
+	writeResult(w, err, code, false)
+}
+
+// proposalDiffHandler serves the changes of a proposal as unified diff, or
+// as list of DiffInfo for diff.json.
+func proposalDiffHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	proposal, err := GetProposal(proposalParam(p))
+	if err == errNoProposal {
+		http.NotFound(w, r)
+		return
+	}
+	Check(err, "reading proposal", 0)
+	if proposal.Head == nil {
+		http.Error(w, "The commits of this proposal are missing.", http.StatusGone)
+		return
+	}
+	infos, text, err := ProposalDiff(proposal)
+	Check(err, "computing diff", 0)
+
+	if strings.HasSuffix(r.URL.Path, ".json") {
+		renderProposalJSON(w, infos, http.StatusOK)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(text)
+}
+
+// commentProposalHandler takes the comment as plain text body.
+func commentProposalHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	text, err := ioutil.ReadAll(r.Body)
+	Check(err, "receiving request", 0)
+	meta := requestCommitMeta(r)
+
+	proposal, err, code := CommentProposal(proposalParam(p), string(text), meta.Author)
+	if err != nil {
+		writeResult(w, err, code, false)
+		return
+	}
+	renderProposalJSON(w, proposal, http.StatusCreated)
+}
+
+func approveProposalHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	meta := requestCommitMeta(r)
+	meta.Branch = ""
+	err, code := ApproveProposal(proposalParam(p), meta)
+	if conflict, ok := err.(*BranchConflict); ok {
+		renderProposalJSON(w, conflict, http.StatusConflict)
+		return
+	}
+	writeResult(w, err, code, false)
+}
+
+// rejectProposalHandler takes an optional comment as plain text body.
+func rejectProposalHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	text, err := ioutil.ReadAll(r.Body)
+	Check(err, "receiving request", 0)
+	meta := requestCommitMeta(r)
+
+	err, code := RejectProposal(proposalParam(p), string(text), meta.Author)
+	writeResult(w, err, code, false)
+}
@@ -0,0 +1,252 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	git "github.com/libgit2/git2go"
+)
+
+const revertSuffix = ".revert"
+
+// RevertConflict is returned by RevertCommit if files changed by the commit
+// were changed again later.
+type RevertConflict struct {
+	Commit *Oid
+	Paths  []string
+}
+
+func (c *RevertConflict) Error() string {
+	return "Changed since " + c.Commit.String() + ": " + strings.Join(c.Paths, ", ")
+}
+
+// resolveRevision resolves rev like LookupRevision, and describes failures
+// with a status code.
+func resolveRevision(rev string) (*git.Commit, error, int) {
+	if rev == "" {
+		return nil, errors.New("No commit given."), http.StatusBadRequest
+	}
+	commit, err := LookupRevision(rev)
+	if err == ErrorNotFound || isNotFound(err) {
+		return nil, errors.New("Revision not found: " + rev), http.StatusNotFound
+	}
+	if err != nil {
+		return nil, err, http.StatusBadRequest
+	}
+	return commit, nil, http.StatusOK
+}
+
+// errUnchanged is returned by the change of RevertFile if the file already
+// is as it is reverted to.
+var errUnchanged = errors.New("File is unchanged.")
+
+// RevertFile restores path to its version at the commit rev, deleting it if
+// it did not exist then. If the file already is as it was, no commit is made.
+// Like PutFile, the commit id is returned as error with status 200.
+func RevertFile(path, rev, lastId string, meta CommitMeta) (error, int) {
+	commit, err, code := resolveRevision(rev)
+	if err != nil {
+		return err, code
+	}
+	defer commit.Free()
+	if path == "/" {
+		return errors.New("Only files can be reverted."), http.StatusBadRequest
+	}
+	target, err := entryAt(commit, path)
+	if err != nil {
+		return err, 0
+	}
+	if target != nil && target.Type != git.ObjectBlob {
+		return errors.New("Only files can be reverted."), http.StatusBadRequest
+	}
+	if meta.Message == "" {
+		meta.Message = "Revert " + path + " to " + commit.Id().String()[:8]
+	}
+
+	var change indexChange
+	if target == nil {
+		change = deleteChange(path, lastId)
+	} else {
+		change = putChange(path, lastId, target.Id, target.Filemode, nil)
+	}
+	err, code = changeHead(meta, func(oldRootTree *git.Tree, index *git.Index) (error, int) {
+		var current *git.TreeEntry
+		if oldRootTree != nil {
+			var err error
+			if current, err = oldRootTree.EntryByPath(path[1:]); isNotFound(err) {
+				current = nil
+			} else if err != nil {
+				return err, 0
+			}
+		}
+		switch {
+		case current == nil && target == nil:
+			if lastId != "" && lastId != "null" {
+				return lastIdError("lastId specified but specified path does not exist."),
+					http.StatusGone
+			}
+			return errUnchanged, http.StatusOK
+		case current != nil && target != nil && current.Id.Equal(target.Id) &&
+			current.Filemode == target.Filemode:
+			if err, code := checkLastId(current.Id, lastId); err != nil {
+				return err, code
+			}
+			return errUnchanged, http.StatusOK
+		}
+		return change(oldRootTree, index)
+	})
+	if err != errUnchanged {
+		return err, code
+	}
+	// nothing to commit, the current commit already has the version
+	head, err := GetBranchCommit(meta.Branch)
+	if err != nil {
+		return err, 0
+	}
+	defer head.Free()
+	return errors.New(head.Id().String()), http.StatusOK
+}
+
+// entryAt returns the entry of path in the tree of commit, nil if it does
+// not exist there.
+func entryAt(commit *git.Commit, path string) (*git.TreeEntry, error) {
+	tree, err := GetCommitTree(commit)
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+	entry, err := tree.EntryByPath(path[1:])
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return entry, err
+}
+
+// RevertCommit undoes the changes a commit made to its first parent. If
+// files it changed were changed again since, a *RevertConflict is returned.
+// Like PutFile, the commit id is returned as error with status 200.
+func RevertCommit(rev string, meta CommitMeta) (error, int) {
+	commit, err, code := resolveRevision(rev)
+	if err != nil {
+		return err, code
+	}
+	defer commit.Free()
+	tree, err := GetCommitTree(commit)
+	if err != nil {
+		return err, 0
+	}
+	defer tree.Free()
+	var parentTreeId *git.Oid
+	if parent := commit.Parent(0); parent != nil {
+		parentTreeId = parent.TreeId()
+		parent.Free()
+	}
+	deltas, err := changedFiles(parentTreeId, tree)
+	if err != nil {
+		return err, 0
+	}
+	if len(deltas) == 0 {
+		return errors.New("The commit changed no files."), http.StatusConflict
+	}
+	if meta.Message == "" {
+		meta.Message = "Revert \"" + commit.Summary() + "\"\n\nThis reverts commit " +
+			commit.Id().String() + "."
+	}
+
+	// Each file has to be as the commit left it. Its version before the
+	// commit is then put back, or it is deleted if the commit added it.
+	paths := make([]string, len(deltas))
+	expected := make([]*git.Oid, len(deltas))
+	changes := make([]indexChange, len(deltas))
+	for i, delta := range deltas {
+		lastId := "null"
+		paths[i] = "/" + delta.OldFile.Path
+		if delta.Status != git.DeltaDeleted {
+			paths[i] = "/" + delta.NewFile.Path
+			expected[i] = delta.NewFile.Oid
+			lastId = delta.NewFile.Oid.String()
+		}
+		if delta.Status == git.DeltaAdded {
+			changes[i] = deleteChange(paths[i], lastId)
+		} else {
+			changes[i] = putChange(paths[i], lastId, delta.OldFile.Oid,
+				git.Filemode(delta.OldFile.Mode), nil)
+		}
+	}
+
+	return changeHead(meta, func(oldRootTree *git.Tree, index *git.Index) (error, int) {
+		conflict := &RevertConflict{Commit: (*Oid)(commit.Id()), Paths: []string{}}
+		for i, path := range paths {
+			var current *git.Object
+			if oldRootTree != nil {
+				var err error
+				if current, err = lookupOld(oldRootTree, path); err != nil {
+					return err, 0
+				}
+			}
+			if (current == nil) != (expected[i] == nil) ||
+				current != nil && !current.Id().Equal(expected[i]) {
+				conflict.Paths = append(conflict.Paths, path)
+			}
+			if current != nil {
+				current.Free()
+			}
+		}
+		if len(conflict.Paths) > 0 {
+			return conflict, http.StatusConflict
+		}
+		for _, change := range changes {
+			if err, code := change(oldRootTree, index); err != nil {
+				return err, code
+			}
+		}
+		return nil, http.StatusOK
+	})
+}
+
+// revertFileHandler serves POST /file.md.revert?to=954abcf2.
+func revertFileHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	path, err := checkPath(strings.TrimSuffix(p.ByName("path"), revertSuffix))
+	Check(err, "in supplied path", http.StatusBadRequest)
+	checkProtectedWrite(r, path)
+	lastId, conditional := requestLastId(r)
+	meta := requestCommitMeta(r)
+
+	err, code := RevertFile(path, r.URL.Query().Get("to"), lastId, meta)
+	writeResult(w, err, code, conditional)
+}
+
+func revertCommitHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	rev := p.ByName("commit")
+	commit, err, code := resolveRevision(rev)
+	if err != nil {
+		writeResult(w, err, code, false)
+		return
+	}
+	paths, err := commitPaths(commit)
+	commit.Free()
+	Check(err, "getting changes", 0)
+	for _, path := range paths {
+		checkProtectedWrite(r, path)
+	}
+	meta := requestCommitMeta(r)
+
+	err, code = RevertCommit(rev, meta)
+	if conflict, ok := err.(*RevertConflict); ok {
+		b, err := json.MarshalIndent(conflict, "", "  ")
+		Check(err, "rendering JSON", http.StatusInternalServerError)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		w.Write(b)
+		return
+	}
+	writeResult(w, err, code, false)
+}
@@ -0,0 +1,334 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"html"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/julienschmidt/httprouter"
+	git "github.com/libgit2/git2go"
+)
+
+const (
+	// maxIndexedSize limits the size of files added to the search index.
+	maxIndexedSize = 1 << 20
+	// defaultSearchLimit is the number of results returned by default.
+	defaultSearchLimit = 20
+	maxSnippets        = 3
+	maxSnippetLength   = 160
+)
+
+type SearchResult struct {
+	Path  string
+	ID    *Oid
+	Score float64
+	// Snippets are HTML-escaped lines of the file, with matches wrapped in
+	// <mark> tags.
+	Snippets []string
+}
+
+type SearchResults struct {
+	Query   string
+	Results []SearchResult
+}
+
+// searchIndex is an inverted index of the words in the files of a tree.
+// It is updated incrementally by diffing the indexed tree against a newer one.
+type searchIndex struct {
+	sync.Mutex
+	// tree is the id of the indexed tree, nil if nothing was indexed yet.
+	tree *git.Oid
+	docs map[string]*searchDoc
+	// postings maps each word to the paths containing it, and how often.
+	postings map[string]map[string]int
+}
+
+type searchDoc struct {
+	id     *git.Oid
+	words  map[string]int
+	length int
+}
+
+var searchIdx = newSearchIndex()
+
+func init() {
+	OnCommit(func(ref string, commit *git.Commit) {
+		searchIdx.Lock()
+		defer searchIdx.Unlock()
+		if searchIdx.tree == nil {
+			// not built yet, will be built on the first search
+			return
+		}
+		// the commit might have been made on another branch
+		if err := searchIdx.sync(); err != nil {
+			log.Println("updating search index:", err)
+		}
+	})
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		docs:     map[string]*searchDoc{},
+		postings: map[string]map[string]int{}}
+}
+
+// sync brings the index up to date with HEAD.
+// The caller must hold the lock.
+func (idx *searchIndex) sync() error {
+	commits, tree, err := readBranch("")
+	freeCommits(commits)
+	if err != nil || tree == nil {
+		return err
+	}
+	defer tree.Free()
+	return idx.update(tree)
+}
+
+// update re-indexes the files which differ between the indexed tree and tree.
+// The caller must hold the lock.
+func (idx *searchIndex) update(tree *git.Tree) error {
+	if idx.tree != nil && idx.tree.Equal(tree.Id()) {
+		return nil
+	}
+	if err := updateTreeIndex(idx, idx.tree, tree); err != nil {
+		return err
+	}
+	idx.tree = tree.Id()
+	return nil
+}
+
+func (idx *searchIndex) add(path string, id *git.Oid) error {
+	if isProtected(path) {
+		return nil
+	}
+	blob, err := repo.LookupBlob(id)
+	if err != nil {
+		return err
+	}
+	defer blob.Free()
+	if blob.Size() > maxIndexedSize {
+		return nil
+	}
+	content := blob.Contents()
+	if bytes.IndexByte(content, 0) != -1 {
+		// binary file
+		return nil
+	}
+
+	doc := &searchDoc{id: id, words: map[string]int{}}
+	for _, word := range searchWords(string(content)) {
+		doc.words[word]++
+		doc.length++
+	}
+	idx.docs[path] = doc
+	for word, count := range doc.words {
+		paths := idx.postings[word]
+		if paths == nil {
+			paths = map[string]int{}
+			idx.postings[word] = paths
+		}
+		paths[path] = count
+	}
+	return nil
+}
+
+func (idx *searchIndex) remove(path string) {
+	doc := idx.docs[path]
+	if doc == nil {
+		return
+	}
+	for word := range doc.words {
+		delete(idx.postings[word], path)
+		if len(idx.postings[word]) == 0 {
+			delete(idx.postings, word)
+		}
+	}
+	delete(idx.docs, path)
+}
+
+// search returns the files containing all words of the query, best matches
+// first. Scores are the sum of tf-idf weights of the query words, normalized
+// by the length of the file.
+func (idx *searchIndex) search(query string, limit int) []SearchResult {
+	idx.Lock()
+	defer idx.Unlock()
+
+	words := uniqueWords(searchWords(query))
+	if len(words) == 0 {
+		return []SearchResult{}
+	}
+	var scores map[string]float64
+	for _, word := range words {
+		paths := idx.postings[word]
+		idf := math.Log(1 + float64(len(idx.docs))/float64(len(paths)+1))
+		if scores == nil {
+			scores = make(map[string]float64, len(paths))
+			for path := range paths {
+				scores[path] = 0
+			}
+		}
+		for path := range scores {
+			count, ok := paths[path]
+			if !ok {
+				delete(scores, path)
+				continue
+			}
+			scores[path] += float64(count) * idf
+		}
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	for path, score := range scores {
+		doc := idx.docs[path]
+		results = append(results, SearchResult{
+			Path:  path,
+			ID:    (*Oid)(doc.id),
+			Score: score / math.Sqrt(float64(doc.length))})
+	}
+	sort.Sort(byScore(results))
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+type byScore []SearchResult
+
+func (r byScore) Len() int      { return len(r) }
+func (r byScore) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byScore) Less(i, j int) bool {
+	if r[i].Score != r[j].Score {
+		return r[i].Score > r[j].Score
+	}
+	return r[i].Path < r[j].Path
+}
+
+// searchWords splits text into lower-case words.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), isWordSeparator)
+}
+
+func isWordSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+func uniqueWords(words []string) []string {
+	seen := map[string]bool{}
+	res := words[:0:0]
+	for _, word := range words {
+		if !seen[word] {
+			seen[word] = true
+			res = append(res, word)
+		}
+	}
+	return res
+}
+
+// snippets returns the first lines of content containing one of words, with
+// the matches highlighted.
+func snippets(content string, words []string) []string {
+	wanted := map[string]bool{}
+	for _, word := range words {
+		wanted[word] = true
+	}
+	res := []string{}
+	for _, line := range strings.Split(content, "\n") {
+		if snippet, ok := highlight(strings.TrimSpace(line), wanted); ok {
+			res = append(res, snippet)
+			if len(res) == maxSnippets {
+				break
+			}
+		}
+	}
+	return res
+}
+
+// highlight HTML-escapes line and wraps the words contained in wanted in
+// <mark> tags. Long lines are cut after maxSnippetLength bytes.
+func highlight(line string, wanted map[string]bool) (string, bool) {
+	var buf bytes.Buffer
+	found := false
+	start := -1
+	flush := func(end int) {
+		word := line[start:end]
+		if wanted[strings.ToLower(word)] {
+			found = true
+			buf.WriteString("<mark>" + html.EscapeString(word) + "</mark>")
+		} else {
+			buf.WriteString(html.EscapeString(word))
+		}
+		start = -1
+	}
+	cut := false
+	for i, r := range line {
+		if i >= maxSnippetLength {
+			line, cut = line[:i], true
+			break
+		}
+		if !isWordSeparator(r) {
+			if start == -1 {
+				start = i
+			}
+			continue
+		}
+		if start != -1 {
+			flush(i)
+		}
+		buf.WriteString(html.EscapeString(string(r)))
+	}
+	if start != -1 {
+		flush(len(line))
+	}
+	if cut {
+		buf.WriteString("…")
+	}
+	return buf.String(), found
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+
+	query := r.URL.Query().Get("q")
+	if strings.TrimSpace(query) == "" {
+		http.Error(w, "Missing query parameter q.", http.StatusBadRequest)
+		return
+	}
+	limit := defaultSearchLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		Check(err, "parsing limit", http.StatusBadRequest)
+		if limit < 1 {
+			http.Error(w, "limit must be positive.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	searchIdx.Lock()
+	err := searchIdx.sync()
+	searchIdx.Unlock()
+	Check(err, "updating search index", 0)
+	results := SearchResults{Query: query, Results: searchIdx.search(query, limit)}
+
+	words := searchWords(query)
+	for i := range results.Results {
+		result := &results.Results[i]
+		blob, err := repo.LookupBlob((*git.Oid)(result.ID))
+		Check(err, "getting blob", 0)
+		result.Snippets = snippets(string(blob.Contents()), words)
+		blob.Free()
+	}
+
+	b, err := json.MarshalIndent(&results, "", "  ")
+	Check(err, "rendering JSON", http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
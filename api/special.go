@@ -0,0 +1,76 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// specialRouter serves endpoints below reserved top-level names like
+// /.search, which are provided by the API instead of the repository.
+type specialRouter struct {
+	*httprouter.Router
+}
+
+// reservedNames holds the top-level names of all special endpoints.
+// Files cannot be written below them.
+var reservedNames = map[string]bool{}
+
+var special = newSpecialRouter()
+
+// handle registers a special endpoint and reserves its top-level name.
+func (s specialRouter) handle(method, path string, handle httprouter.Handle) {
+	reservedNames[topLevelName(path)] = true
+	s.Handle(method, path, handle)
+}
+
+func newSpecialRouter() specialRouter {
+	s := specialRouter{httprouter.New()}
+	s.handle("GET", "/.search", searchHandler)
+	s.handle("GET", "/.links/orphans", orphansHandler)
+	s.handle("GET", "/.links/broken", brokenLinksHandler)
+	s.handle("POST", "/.commit", commitHandler)
+	s.handle("GET", "/.branches", branchesHandler)
+	s.handle("PUT", "/.branches/:name", createBranchHandler)
+	s.handle("POST", "/.branches/:name/merge", mergeBranchHandler)
+	s.handle("GET", "/.proposals", proposalsHandler)
+	s.handle("POST", "/.proposals", createProposalHandler)
+	s.handle("GET", "/.proposals/:id", proposalHandler)
+	s.handle("POST", "/.proposals/:id", updateProposalHandler)
+	s.handle("GET", "/.proposals/:id/diff", proposalDiffHandler)
+	s.handle("GET", "/.proposals/:id/diff.json", proposalDiffHandler)
+	s.handle("POST", "/.proposals/:id/comments", commentProposalHandler)
+	s.handle("POST", "/.proposals/:id/approve", approveProposalHandler)
+	s.handle("POST", "/.proposals/:id/reject", rejectProposalHandler)
+	s.handle("GET", "/.webhooks/deliveries", deliveriesHandler)
+	s.handle("GET", "/.events", eventsHandler)
+	s.handle("GET", "/.mirrors", mirrorsHandler)
+	s.handle("GET", "/.changes", changesHandler)
+	s.handle("GET", "/.changes.atom", changesAtomHandler)
+	s.handle("POST", "/.revert/:commit", revertCommitHandler)
+	s.handle("GET", gitPrefix+"/*path", gitHandler)
+	s.handle("POST", gitPrefix+"/*path", gitHandler)
+	return s
+}
+
+// topLevelName returns the first element of path.
+func topLevelName(path string) string {
+	return strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+}
+
+func isReserved(path string) bool {
+	return reservedNames[topLevelName(path)]
+}
+
+// withSpecial sends requests for reserved names to special, and all other
+// requests to handler.
+func withSpecial(special specialRouter, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isReserved(r.URL.Path) {
+			special.ServeHTTP(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
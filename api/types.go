@@ -1,6 +1,7 @@
 package api
 
 import (
+	"encoding/json"
 	"net/http"
 	"time"
 
@@ -12,6 +13,7 @@ type Oid git.Oid
 type RequestContext struct {
 	w          http.ResponseWriter
 	path       string
+	urlPath    string
 	rootTree   *git.Tree
 	rootCommit *git.Commit
 }
@@ -28,17 +30,39 @@ type AuthorInfo struct {
 	Name, Email string
 }
 
+// CommitMeta describes who made a change, and why.
+type CommitMeta struct {
+	Message string
+	Author  AuthorInfo
+	// Committer defaults to Author.
+	Committer AuthorInfo
+	// Date is the author date. The zero value means now.
+	Date time.Time
+	// Branch is the branch to commit to. Empty means the one HEAD refers to.
+	Branch string
+}
+
 type CommitInfo struct {
 	ID        *Oid
 	Date      time.Time
 	CommitMsg string
 	Author    AuthorInfo
+
+	// fileId is the version of the file the history is about, changedBy the
+	// commit which changed the file to it, if known.
+	fileId    *git.Oid
+	changedBy *git.Oid
 }
 
 type FileInfo struct {
 	Path    string
 	ID      *Oid
 	History []CommitInfo
+	// Backlinks lists the Markdown pages linking to this path, and
+	// OutgoingLinks the paths linked from this page.
+	// Both are only set for the current version.
+	Backlinks     []string `json:",omitempty"`
+	OutgoingLinks []string `json:",omitempty"`
 }
 
 type TreeInfo struct {
@@ -46,9 +70,34 @@ type TreeInfo struct {
 	Files []GitEntry
 }
 
+// HistoryEntry is one line of a history listing.
+type HistoryEntry struct {
+	Name  string
+	IsDir bool
+	CommitInfo
+}
+
+type HistoryListing struct {
+	Path    string
+	ID      *Oid
+	Entries []HistoryEntry
+}
+
 func (id Oid) MarshalJSON() ([]byte, error) {
 	return []byte(`"` + id.String() + `"`), nil
 }
+func (id *Oid) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	oid, err := git.NewOid(s)
+	if err != nil {
+		return err
+	}
+	*id = Oid(*oid)
+	return nil
+}
 func (id *Oid) String() string {
 	if id == nil {
 		return ""
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+// refWatchInterval is how often the branches are checked for commits made
+// outside the API, for example by git push.
+const refWatchInterval = 2 * time.Second
+
+// maxWatchedCommits limits the commits hooks are run for when a branch moved
+// outside the API. Only the newest ones are passed on.
+const maxWatchedCommits = 1000
+
+// knownRefs holds the last commit seen on each branch. Like the branches, it
+// is guarded by writeLock.
+var knownRefs = map[string]*git.Oid{}
+
+// watchRefs runs the commit hooks for commits which were added to the
+// branches outside the API. It does not return.
+func watchRefs() {
+	if err := checkRefs(false); err != nil {
+		log.Println("watching refs:", err)
+	}
+	for range time.Tick(refWatchInterval) {
+		if err := checkRefs(true); err != nil {
+			log.Println("watching refs:", err)
+		}
+	}
+}
+
+// movedRef lists the new commits of a branch which moved outside the API,
+// oldest first.
+type movedRef struct {
+	ref string
+	ids []*git.Oid
+}
+
+// checkRefs updates knownRefs, and if notify is set, runs the commit hooks
+// for the new commits of branches which moved. The hooks run after writeLock
+// is released, so that writes are not held up by reading the commits. Only
+// the hooks of later commits wait for them, keeping the order.
+func checkRefs(notify bool) error {
+	writeLock.Lock()
+	moved, err := scanRefs(notify)
+	hookLock.Lock()
+	writeLock.Unlock()
+	defer hookLock.Unlock()
+	for _, m := range moved {
+		for _, id := range m.ids {
+			callCommitHooks(m.ref, id)
+		}
+	}
+	return err
+}
+
+// scanRefs compares the branches to knownRefs, and returns the new commits of
+// branches which moved if notify is set.
+// writeLock has to be held.
+func scanRefs(notify bool) ([]movedRef, error) {
+	iter, err := repo.NewReferenceIteratorGlob(branchPrefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Free()
+	names := iter.Names()
+
+	var moved []movedRef
+	seen := map[string]bool{}
+	for {
+		name, err := names.Next()
+		if gitErr, ok := err.(*git.GitError); ok && gitErr.Code == git.ErrIterOver {
+			break
+		}
+		if err != nil {
+			return moved, err
+		}
+		ref, err := repo.References.Lookup(name)
+		if isNotFound(err) {
+			continue
+		} else if err != nil {
+			return moved, err
+		}
+		if ref.Type() != git.ReferenceOid {
+			continue
+		}
+		id := ref.Target()
+		seen[name] = true
+
+		old, known := knownRefs[name]
+		knownRefs[name] = id
+		if notify && known && !old.Equal(id) {
+			log.Printf("%s moved to %s outside the API\n", name, id)
+			ids, err := commitsSince(old, id)
+			if err != nil {
+				return moved, err
+			}
+			moved = append(moved, movedRef{name, ids})
+		}
+	}
+	for name := range knownRefs {
+		if strings.HasPrefix(name, branchPrefix) && !seen[name] {
+			delete(knownRefs, name)
+		}
+	}
+	return moved, nil
+}
+
+// commitsSince returns the commits reachable from id but not from old, oldest
+// first. Only the newest maxWatchedCommits are returned.
+func commitsSince(old, id *git.Oid) ([]*git.Oid, error) {
+	walk, err := repo.Walk()
+	if err != nil {
+		return nil, err
+	}
+	defer walk.Free()
+	walk.Sorting(git.SortTopological | git.SortReverse)
+	if err := walk.Push(id); err != nil {
+		return nil, err
+	}
+	// old may be gone after a forced push
+	walk.Hide(old)
+
+	ids := []*git.Oid{}
+	for {
+		next := new(git.Oid)
+		err := walk.Next(next)
+		if git.IsErrorCode(err, git.ErrIterOver) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, next)
+	}
+	if len(ids) > maxWatchedCommits {
+		ids = ids[len(ids)-maxWatchedCommits:]
+	}
+	return ids, nil
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	git "github.com/libgit2/git2go"
+)
+
+// Webhook is an URL notified after each commit, configured in the Webhooks
+// section of the config file.
+type Webhook struct {
+	URL string
+	// Secret is the key of the HMAC-SHA256 of the body, which is sent
+	// hex-encoded in the X-Wiki-Signature header as "sha256=<hmac>".
+	Secret string
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookDelivery records the attempts to send a payload to one webhook.
+type WebhookDelivery struct {
+	ID     int
+	URL    string
+	Ref    string
+	Commit *Oid
+	// Status is "pending", "delivered" or "failed".
+	Status   string
+	Attempts []DeliveryAttempt
+}
+
+// DeliveryAttempt is one request to a webhook. StatusCode is 0 if no
+// response was received.
+type DeliveryAttempt struct {
+	Date       time.Time
+	StatusCode int
+	Error      string `json:",omitempty"`
+}
+
+type DeliveryLog struct {
+	Deliveries []WebhookDelivery
+}
+
+const (
+	// webhookAttempts is the number of times a delivery is tried, waiting
+	// webhookBackoff after the first failure, and twice as long after each
+	// further one.
+	webhookAttempts = 6
+	webhookBackoff  = 2 * time.Second
+	// maxDeliveries is the number of deliveries kept in the log.
+	maxDeliveries = 200
+)
+
+var webhookClient = &http.Client{Timeout: 30 * time.Second}
+
+// deliveries is the delivery log, oldest first.
+var deliveries struct {
+	sync.Mutex
+	lastId int
+	log    []*WebhookDelivery
+}
+
+func init() {
+	OnCommit(func(ref string, commit *git.Commit) {
+		if len(config.Webhooks) == 0 {
+			return
+		}
+		event, err := newCommitEvent(ref, commit)
+		if err != nil {
+			log.Println("webhooks:", err)
+			return
+		}
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Println("webhooks:", err)
+			return
+		}
+		for _, hook := range config.Webhooks {
+			delivery := newDelivery(hook, ref, commit.Id())
+			go deliver(hook, delivery, body)
+		}
+	})
+}
+
+// newDelivery adds a pending delivery to the log, dropping the oldest one if
+// it is full.
+func newDelivery(hook Webhook, ref string, id *git.Oid) *WebhookDelivery {
+	deliveries.Lock()
+	defer deliveries.Unlock()
+	deliveries.lastId++
+	delivery := &WebhookDelivery{
+		ID:       deliveries.lastId,
+		URL:      hook.URL,
+		Ref:      ref,
+		Commit:   (*Oid)(id),
+		Status:   DeliveryPending,
+		Attempts: []DeliveryAttempt{}}
+	if len(deliveries.log) == maxDeliveries {
+		deliveries.log = deliveries.log[1:]
+	}
+	deliveries.log = append(deliveries.log, delivery)
+	return delivery
+}
+
+// deliver posts body to hook until it succeeds or webhookAttempts are used
+// up, recording each attempt in delivery.
+func deliver(hook Webhook, delivery *WebhookDelivery, body []byte) {
+	mac := hmac.New(sha256.New, []byte(hook.Secret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	wait := webhookBackoff
+	for i := 1; ; i++ {
+		attempt := DeliveryAttempt{Date: time.Now()}
+		err := postWebhook(hook.URL, body, signature, delivery.ID, &attempt)
+		if err != nil {
+			attempt.Error = err.Error()
+		}
+
+		deliveries.Lock()
+		delivery.Attempts = append(delivery.Attempts, attempt)
+		switch {
+		case err == nil:
+			delivery.Status = DeliveryDelivered
+		case i == webhookAttempts:
+			delivery.Status = DeliveryFailed
+		}
+		status := delivery.Status
+		deliveries.Unlock()
+
+		if status != DeliveryPending {
+			if status == DeliveryFailed {
+				log.Printf("webhook %s: giving up on delivery %d: %v\n",
+					hook.URL, delivery.ID, err)
+			}
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// postWebhook sends one request, storing the response status in attempt.
+func postWebhook(url string, body []byte, signature string, id int,
+	attempt *DeliveryAttempt) error {
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Wiki-Event", "commit")
+	req.Header.Set("X-Wiki-Delivery", strconv.Itoa(id))
+	req.Header.Set("X-Wiki-Signature", signature)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// deliveriesHandler lists the webhook deliveries, newest first. Only admins
+// may see them.
+func deliveriesHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer HttpErrorOnPanic(w, http.StatusInternalServerError)
+	checkAdmin(r)
+
+	status := r.URL.Query().Get("status")
+	deliveries.Lock()
+	list := DeliveryLog{[]WebhookDelivery{}}
+	for i := len(deliveries.log) - 1; i >= 0; i-- {
+		if status == "" || deliveries.log[i].Status == status {
+			list.Deliveries = append(list.Deliveries, *deliveries.log[i])
+		}
+	}
+	b, err := json.MarshalIndent(&list, "", "  ")
+	deliveries.Unlock()
+	Check(err, "rendering JSON", http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/cfstras/wiki-api/api"
+)
+
+// checkLinks implements the check-links subcommand. It prints the broken
+// links of a repository, and returns exit code 1 if there are any which are
+// not listed in the baseline file.
+func checkLinks(args []string) int {
+	flags := flag.NewFlagSet("check-links", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s check-links:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "    %s check-links [flags] <repository>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	var baselinePath string
+	var updateBaseline bool
+	flags.StringVar(&baselinePath, "baseline", "",
+		"JSON file with known broken links, as returned by /.links/broken")
+	flags.BoolVar(&updateBaseline, "update-baseline", false,
+		"Write the current broken links to the baseline file")
+	flags.Parse(args)
+	if flags.NArg() != 1 || (updateBaseline && baselinePath == "") {
+		flags.Usage()
+		return 2
+	}
+
+	if err := api.OpenRepo(flags.Arg(0)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	broken, err := api.BrokenLinks()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "checking links:", err)
+		return 2
+	}
+
+	if updateBaseline {
+		b, err := json.MarshalIndent(&api.BrokenLinksReport{Broken: broken}, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(baselinePath, b, 0644)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "writing baseline:", err)
+			return 2
+		}
+		fmt.Printf("%d broken links written to %s\n", len(broken), baselinePath)
+		return 0
+	}
+
+	// links are identified by page and target, as line numbers change
+	known := map[[2]string]bool{}
+	if baselinePath != "" {
+		var baseline api.BrokenLinksReport
+		b, err := ioutil.ReadFile(baselinePath)
+		if err == nil {
+			err = json.Unmarshal(b, &baseline)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "reading baseline:", err)
+			return 2
+		}
+		for _, link := range baseline.Broken {
+			known[[2]string{link.Source, link.Target}] = true
+		}
+	}
+
+	regressions := 0
+	for _, link := range broken {
+		status := "known"
+		if !known[[2]string{link.Source, link.Target}] {
+			status = "NEW"
+			regressions++
+		}
+		fmt.Printf("%s:%d: %s -> %s (%s)\n", link.Source, link.Line, link.Link,
+			link.Target, status)
+	}
+	fmt.Printf("%d broken links, %d new\n", len(broken), regressions)
+	if regressions > 0 {
+		return 1
+	}
+	return 0
+}
@@ -102,7 +102,12 @@ func importHistory(hist History) {
 			log.Println("opening", e.FilePath, ":", err, ". Skipping.")
 			continue
 		}
-		err, code := api.PutFile(e.TargetPath, "", e.Message, body)
+		meta := api.CommitMeta{
+			Message: e.Message,
+			Author:  api.AuthorInfo{Name: e.Author},
+			Date:    e.Date,
+		}
+		err, code := api.PutFile(e.TargetPath, "", false, meta, body)
 		if code != http.StatusOK {
 			log.Fatalln("importing", e.TargetPath, ":", code, err)
 		}
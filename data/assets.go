@@ -2,6 +2,7 @@
 // sources:
 // assets.go
 // data.go
+// historyOf.mustache
 // indexOf.mustache
 // DO NOT EDIT!
 
@@ -110,6 +111,26 @@ func dataGo() (*asset, error) {
 	return a, nil
 }
 
+var _historyofMustache = []byte("\x1f\x8b\x08\x00\x00\x09\x6e\x88\x00\xff\x7c\x50\xc1\x6e\xe3\x20\x10\x3d\xe3\xaf\x60\x9d\xcb\xee\x21\x21\x59\x69\x2f\x5e\x82\xb4\xda\x54\x6a\x0f\xa9\xfa\x0b\xd8\x60\x83\x0a\x26\x82\xc9\xc1\x1a\xf1\xef\x95\x9d\x38\x75\xaa\xa8\xb7\x99\x79\x6f\xe6\xbd\x79\xfc\x87\x0a\x0d\x0c\x27\x4d\x0d\x78\x27\x0a\x6e\xb4\x54\xa2\x20\x1c\x2c\x38\x2d\x9e\x6d\x82\x10\x07\x1a\x5a\x8a\xf8\x26\xc1\xe4\xcc\xd9\x05\x2a\x08\x4f\x30\x4c\x05\xd9\xb4\xd6\xe9\x44\x41\x51\x2c\x08\x21\x27\xa9\x94\xed\xbb\x8a\x6e\xb5\xa7\xdb\xcd\x1f\xed\xff\x16\x84\xe4\x05\xb1\x0e\x6a\xb8\x70\xdb\xd0\xc3\xba\x95\xde\xba\xa1\xa2\x3e\xf4\x21\x9d\x64\xa3\xbf\xf2\x47\x57\xb7\xf3\xb5\x6c\xde\xbb\x18\xce\xbd\x5a\x37\xc1\x85\x58\xd1\x95\x52\xea\xa1\x04\xc4\xaa\x07\xb3\x6e\x8c\x75\xea\xe7\xef\xfe\xd7\x77\x37\xb4\x9e\x65\x39\xbb\x7e\xc6\xd9\x28\x3c\xa6\xb2\x7b\x1c\x85\xd9\x89\x82\x83\xac\x9d\xa6\x8d\x93\x29\xed\xcb\xe9\xc1\x72\x4a\xf0\x1a\x25\xe1\xa0\xc4\xab\xf4\x9a\x33\xb8\xf5\x07\x09\x77\xfd\xbf\x33\x98\x10\x97\x93\xa3\x4e\x49\x76\x33\x89\xb3\xf9\x1c\xe2\xea\xa9\x87\x68\x75\xca\x79\x54\x89\xf3\x02\x97\xd4\x44\xdd\xee\x4b\xc4\x51\x2d\x67\xc4\xd5\x4b\x3a\xd8\x98\x33\x43\x64\xd7\xb2\x14\x33\xcc\x99\x14\x4b\x41\xc4\xd1\x54\xce\xf7\xb3\x8b\xb1\xcd\xbc\xb2\x84\xfe\x07\xef\x2d\x1c\x53\x77\x03\x38\x9b\xec\x20\xb2\x4f\x8b\x9c\x81\xac\x9d\x16\xc5\xc7\x00\x0a\xa6\x4d\xa6\x6b\x02\x00\x00")
+
+func historyofMustacheBytes() ([]byte, error) {
+	return bindataRead(
+		_historyofMustache,
+		"historyOf.mustache",
+	)
+}
+
+func historyofMustache() (*asset, error) {
+	bytes, err := historyofMustacheBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "historyOf.mustache", size: 619, mode: os.FileMode(420), modTime: time.Unix(1792240110, 0)}
+	a := &asset{bytes: bytes, info: info}
+	return a, nil
+}
+
 var _indexofMustache = []byte("\x1f\x8b\x08\x00\x00\x09\x6e\x88\x00\xff\x7c\x50\x3d\x6b\xf3\x30\x10\x9e\xa5\x5f\xa1\xd7\x59\xde\x0e\x89\x92\x42\x17\xf7\xa2\x29\x04\xb2\x94\x0e\x9d\x0b\x8a\x25\x47\xa6\xb2\x64\xac\x2b\xd4\x1c\xfe\xef\xc5\x8e\x9d\xa4\x25\x74\xbb\xd3\x3d\x5f\x7a\xe0\x9f\x89\x05\x76\x8d\x15\x0e\x6b\xaf\x38\x38\xab\x8d\xe2\x0c\xb0\x42\x6f\xd5\x21\x18\xfb\x25\x62\x29\x88\x5e\x35\xba\xbe\x07\x79\x3e\x70\x06\x09\xbb\x71\x60\xab\xb2\xf2\x36\x09\x34\x82\x38\x63\xac\xd1\xc6\x54\xe1\x94\x8b\xb5\xad\xc5\x7a\xf5\x64\xeb\x67\xce\x58\x7f\x03\x3c\x46\xd3\x9d\xb1\x65\x0c\xb8\x2c\x75\x5d\xf9\x2e\x17\x75\x0c\x31\x35\xba\xb0\xbf\xf1\x43\xa6\x8b\xfc\x51\x17\x1f\xa7\x36\x7e\x06\xb3\x2c\xa2\x8f\x6d\x2e\x16\xc6\x98\xbb\x16\xd8\xe6\x01\xdd\xb2\x70\x95\x37\xff\x1f\xc3\xc3\x5f\x1a\xd6\xce\xb6\x20\xa7\x9f\x81\x3c\x97\x01\x6e\x73\xaf\x08\xb7\x51\x1c\x50\x1f\xbd\x15\x85\xd7\x29\x6d\xb3\xd1\x3b\x1b\xdb\x9b\x6a\x64\x80\x46\xbd\x75\x8d\x05\x89\x97\xfd\x45\xd7\x3f\xf6\xe4\xf4\xb4\x82\x9c\x89\x44\x8b\xfd\xa0\xd6\x0f\x81\xb0\x9d\xa1\x44\x8b\x43\xda\x55\x6d\xdf\xef\x88\xe4\x34\x12\xbd\x4f\xd3\xfe\xfa\x78\x6b\x00\x5a\xb8\xd6\x96\xdb\x8c\x68\xf0\x1e\x18\xb3\x8c\xbc\x32\x32\x35\x9f\x41\x6a\x75\xcb\x27\x3a\xec\x2e\x8a\x20\xc7\x38\x44\x72\x0e\x08\x72\x6c\x41\xf1\xef\x00\x00\x00\xff\xff\x9c\x47\xfe\x1e\x4d\x02\x00\x00")
 
 func indexofMustacheBytes() ([]byte, error) {
@@ -184,6 +205,7 @@ func AssetNames() []string {
 var _bindata = map[string]func() (*asset, error){
 	"assets.go": assetsGo,
 	"data.go": dataGo,
+	"historyOf.mustache": historyofMustache,
 	"indexOf.mustache": indexofMustache,
 }
 
@@ -229,6 +251,7 @@ type bintree struct {
 var _bintree = &bintree{nil, map[string]*bintree{
 	"assets.go": &bintree{assetsGo, map[string]*bintree{}},
 	"data.go": &bintree{dataGo, map[string]*bintree{}},
+	"historyOf.mustache": &bintree{historyofMustache, map[string]*bintree{}},
 	"indexOf.mustache": &bintree{indexofMustache, map[string]*bintree{}},
 }}
 
@@ -13,13 +13,18 @@ func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "    %s <repository>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "    %s check-links [flags] <repository>\n", os.Args[0])
 		flag.PrintDefaults()
 	}
+	if len(os.Args) > 1 && os.Args[1] == "check-links" {
+		os.Exit(checkLinks(os.Args[2:]))
+	}
 
-	var listenOn string
+	var listenOn, configPath string
 	var debug bool
 	flag.StringVar(&listenOn, "l", ":3000", "Bind address")
 	flag.BoolVar(&debug, "debug", false, "Enable /debug/pprof")
+	flag.StringVar(&configPath, "config", "", "JSON config file")
 
 	flag.Parse()
 	if len(flag.Args()) != 1 {
@@ -28,5 +33,12 @@ func main() {
 	}
 	repoPath := flag.Args()[0]
 
+	if configPath != "" {
+		if err := api.LoadConfig(configPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
 	fmt.Println(api.Run(listenOn, repoPath, debug))
 }